@@ -0,0 +1,130 @@
+package jsonmatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// decimalFromValue converts any numeric value to an exact decimal string
+// representation. Floats are represented with the shortest decimal that
+// round-trips, so 0.1 becomes "0.1" and not the exact binary fraction.
+func decimalFromValue(v interface{}) (string, bool) {
+	if number, ok := v.(json.Number); ok {
+		if _, isNumber := floatFromValue(number); !isNumber {
+			return "", false
+		}
+		return string(number), true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), true
+	case reflect.Float32:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 32), true
+	case reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// decimalPlaces returns the number of digits needed after the decimal point
+// to represent the decimal string exactly, taking any exponent into account.
+func decimalPlaces(decimal string) int {
+	mantissa := strings.ToLower(decimal)
+	exponent := 0
+	if i := strings.IndexByte(mantissa, 'e'); i >= 0 {
+		exponent, _ = strconv.Atoi(mantissa[i+1:])
+		mantissa = mantissa[:i]
+	}
+	places := 0
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		places = len(mantissa) - i - 1
+	}
+	places -= exponent
+	if places < 0 {
+		return 0
+	}
+	return places
+}
+
+// addNumeric adds delta to value while preserving the Go type of value. Integer
+// values only accept integral deltas and report overflow, json.Number values are
+// added using exact decimal arithmetic.
+func addNumeric(value interface{}, delta *big.Rat, deltaPlaces int) (interface{}, error) {
+	if number, ok := value.(json.Number); ok {
+		current, ok := new(big.Rat).SetString(string(number))
+		if !ok {
+			return nil, fmt.Errorf("%q is not a valid number", number)
+		}
+		places := decimalPlaces(string(number))
+		if deltaPlaces > places {
+			places = deltaPlaces
+		}
+		return json.Number(current.Add(current, delta).FloatString(places)), nil
+	}
+
+	v := reflect.ValueOf(value)
+	result := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !delta.IsInt() {
+			return nil, fmt.Errorf("Cannot add fractional amount %s to integer value %v", delta.RatString(), value)
+		}
+		sum := new(big.Int).Add(big.NewInt(v.Int()), delta.Num())
+		if !sum.IsInt64() || v.OverflowInt(sum.Int64()) {
+			return nil, fmt.Errorf("Adding %s to %v overflows %s", delta.RatString(), value, v.Type())
+		}
+		result.SetInt(sum.Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !delta.IsInt() {
+			return nil, fmt.Errorf("Cannot add fractional amount %s to integer value %v", delta.RatString(), value)
+		}
+		sum := new(big.Int).Add(new(big.Int).SetUint64(v.Uint()), delta.Num())
+		if sum.Sign() < 0 || !sum.IsUint64() || v.OverflowUint(sum.Uint64()) {
+			return nil, fmt.Errorf("Adding %s to %v overflows %s", delta.RatString(), value, v.Type())
+		}
+		result.SetUint(sum.Uint64())
+	case reflect.Float32, reflect.Float64:
+		f, _ := delta.Float64()
+		result.SetFloat(v.Float() + f)
+	default:
+		return nil, fmt.Errorf("%T is not a numeric type", value)
+	}
+	return result.Interface(), nil
+}
+
+// incrementMutator returns a mutator that adds the numeric amount to every value
+// it is given, or subtracts it if negate is true.
+func incrementMutator(amount interface{}, negate bool) (MutatorFunc, error) {
+	decimal, ok := decimalFromValue(amount)
+	if !ok {
+		return nil, fmt.Errorf("Increment amount must be numeric, got %T", amount)
+	}
+	delta, ok := new(big.Rat).SetString(decimal)
+	if !ok {
+		return nil, fmt.Errorf("Increment amount %q is not a valid number", decimal)
+	}
+	if negate {
+		delta.Neg(delta)
+	}
+	places := decimalPlaces(decimal)
+	return func(path string, value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, fmt.Errorf("Cannot increment missing value at %s", path)
+		}
+		if _, isNumber := floatFromValue(value); !isNumber {
+			return nil, fmt.Errorf("Cannot increment non-numeric value %v at %s", value, path)
+		}
+		result, err := addNumeric(value, delta, places)
+		if err != nil {
+			return nil, fmt.Errorf("%s at %s", err, path)
+		}
+		return result, nil
+	}, nil
+}
@@ -1,8 +1,11 @@
 package jsonmatch
 
-// Expression represents a compiled JSONpath epxression
+// Expression represents a compiled JSONpath epxression. An Expression is never
+// modified after parsing, so it is safe for concurrent use by multiple goroutines.
 type Expression struct {
 	root node
+	// The root compiled for evaluation, reused for every document matched
+	plan step
 }
 
 type node interface {
@@ -59,9 +62,14 @@ type wildcardNode struct {
 	pos int
 }
 
-// An operator matching all descendants from the current values downwards `..`
+// An operator matching all descendants from the current values downwards `..`. The
+// levels of nesting matched may be bounded, as in `..{1,3}`, where the current
+// values are level 0.
 type recursiveNode struct {
-	pos int
+	pos               int
+	minDepth          int
+	maxDepth          int
+	maxDepthSpecified bool
 }
 
 // A union of two paths, as in `foo[bar,bat].baz` or `array[1,3,5:9]`
@@ -108,3 +116,24 @@ func (n *unionNode) position() int         { return n.pos }
 func (n *filterNode) position() int        { return n.pos }
 func (n *selfNode) position() int          { return n.pos }
 func (n *indexNode) position() int         { return n.pos }
+
+// countNodes returns the number of nodes in the tree
+func countNodes(n node) int {
+	count := 1
+	switch t := n.(type) {
+	case *pathNode:
+		for _, child := range t.nodes {
+			count += countNodes(child)
+		}
+	case *unionNode:
+		for _, child := range t.nodes {
+			count += countNodes(child)
+		}
+	case *filterNode:
+		count += countNodes(t.lhs)
+		if t.rhs != nil {
+			count += countNodes(t.rhs)
+		}
+	}
+	return count
+}
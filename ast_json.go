@@ -97,10 +97,18 @@ func (n *wildcardNode) MarshalJSON() ([]byte, error) {
 }
 
 func (n *recursiveNode) MarshalJSON() ([]byte, error) {
+	var maxDepth *int
+	if n.maxDepthSpecified {
+		maxDepth = &n.maxDepth
+	}
 	return json.Marshal(struct {
-		Node string `json:"node"`
+		Node     string `json:"node"`
+		MinDepth int    `json:"minDepth,omitempty"`
+		MaxDepth *int   `json:"maxDepth,omitempty"`
 	}{
 		"recursive",
+		n.minDepth,
+		maxDepth,
 	})
 }
 
@@ -18,6 +18,9 @@ func isCanonicalType(t reflect.Type) bool {
 
 // Converts maps and arrays to their canonical types
 func toCanonicalType(value interface{}) (interface{}, bool, error) {
+	if value == nil {
+		return nil, false, nil
+	}
 	valueType := reflect.TypeOf(value)
 	if valueType.Kind() == reflect.Map && valueType != canonicalMapType {
 		if !valueType.ConvertibleTo(canonicalMapType) {
@@ -0,0 +1,333 @@
+package jsonmatch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// changeKind tells what kind of change was made to a document
+type changeKind int
+
+const (
+	// A value was set, creating it if it did not exist
+	changeSet changeKind = iota
+	// A key was deleted from a map
+	changeDelete
+	// Regions of an array were replaced by new items
+	changeSplice
+)
+
+// change records one change made by a ref, with enough information to revert it
+type change struct {
+	kind changeKind
+	// The keys and indicies leading to the changed value, or to the array for splices
+	path []interface{}
+	// Whether there was a value at the path before the change
+	existed bool
+	// The value at the path before and after the change
+	before interface{}
+	after  interface{}
+	// For splices, the regions that were replaced
+	replaced Regions
+	// For splices, the regions now covering the inserted items
+	regions Regions
+	// For splices, the items that were replaced and inserted in each region
+	removed  [][]interface{}
+	inserted [][]interface{}
+	// Changes made in dry-run mode were reverted right away
+	dryRun bool
+}
+
+// journal collects the changes made to a document through the refs of a match
+type journal struct {
+	changes []change
+	// Set while performing mutations in dry-run mode
+	dryRun bool
+}
+
+// ContainerObserver is notified of every map or slice a mutation rewrites, with the
+// jsonmatch path of the container, the container before the mutation and the copy
+// replacing it. A container is rewritten when any value inside it changes, so a
+// change deep in the document is reported for each of the containers holding it,
+// starting with the document itself.
+type ContainerObserver func(path string, oldValue, newValue interface{})
+
+// containerRewrite is a notification waiting to be delivered to a ContainerObserver
+type containerRewrite struct {
+	path     string
+	oldValue interface{}
+	newValue interface{}
+}
+
+// observer delivers container rewrites to a ContainerObserver
+type observer struct {
+	callback ContainerObserver
+	// While holding, notifications are queued until the mutation is known to be kept
+	holding bool
+	held    []containerRewrite
+}
+
+// notify delivers or queues a notification of the rewritten container at the path
+func (o *observer) notify(path []interface{}, oldValue, newValue interface{}) {
+	rewrite := containerRewrite{path: formatPath(path), oldValue: oldValue, newValue: newValue}
+	if o.holding {
+		o.held = append(o.held, rewrite)
+		return
+	}
+	o.callback(rewrite.path, rewrite.oldValue, rewrite.newValue)
+}
+
+// hold queues notifications until release is called
+func (o *observer) hold() {
+	o.holding = true
+}
+
+// release stops queueing notifications, delivering the queued ones if deliver is true
+func (o *observer) release(deliver bool) {
+	held := o.held
+	o.holding, o.held = false, nil
+	if !deliver {
+		return
+	}
+	for _, rewrite := range held {
+		o.callback(rewrite.path, rewrite.oldValue, rewrite.newValue)
+	}
+}
+
+// root returns the variable holding the whole document
+func (r *VarRef) root() *VarRef {
+	for r.parent != nil {
+		r = r.parent
+	}
+	return r
+}
+
+// recording is true if changes made through the variable should be recorded
+func (r *VarRef) recording() bool {
+	return r.root().journal != nil
+}
+
+// record adds the change to the journal of the document, if there is one
+func (r *VarRef) record(c change) {
+	if j := r.root().journal; j != nil {
+		c.dryRun = j.dryRun
+		j.changes = append(j.changes, c)
+	}
+}
+
+// recordMember records that the member with the key or index in the map or array
+// held by the variable is about to be set
+func (r *VarRef) recordMember(key interface{}, existed bool, before, after interface{}) {
+	if r.recording() {
+		r.record(change{kind: changeSet, path: r.childPath(key), existed: existed, before: before, after: after})
+	}
+}
+
+// recordDeletedMember records that the key is about to be deleted from the map held
+// by the variable
+func (r *VarRef) recordDeletedMember(key string, before interface{}) {
+	if r.recording() {
+		r.record(change{kind: changeDelete, path: r.childPath(key), existed: true, before: before})
+	}
+}
+
+// memberKey returns the key of the variable in the map holding it, or its index in
+// the array holding it
+func (r *VarRef) memberKey() interface{} {
+	if r.inMap {
+		return r.name
+	}
+	return r.index
+}
+
+// path returns the keys and indicies leading from the root to the variable
+func (r *VarRef) path() []interface{} {
+	var result []interface{}
+	for v := r; v.parent != nil; v = v.parent {
+		result = append(result, v.memberKey())
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// childPath returns the path of the member of the variable with the key or index
+func (r *VarRef) childPath(key interface{}) []interface{} {
+	return append(r.path(), key)
+}
+
+// formatPath formats a path of keys and indicies as a jsonmatch expression
+func formatPath(path []interface{}) string {
+	if len(path) == 0 {
+		return "$"
+	}
+	var result strings.Builder
+	for _, key := range path {
+		switch k := key.(type) {
+		case string:
+			if isPlainIdentifier(k) {
+				if result.Len() > 0 {
+					result.WriteString(".")
+				}
+				result.WriteString(k)
+			} else {
+				escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(k)
+				fmt.Fprintf(&result, "['%s']", escaped)
+			}
+		case int:
+			fmt.Fprintf(&result, "[%d]", k)
+		}
+	}
+	return result.String()
+}
+
+// isPlainIdentifier is true if the key can be used in a jsonmatch expression
+// without quoting
+func isPlainIdentifier(key string) bool {
+	switch key {
+	case "", "$", "true", "false":
+		return false
+	}
+	for i, ch := range key {
+		if !isIdentifierCharacter(ch) || i == 0 && !isIdentifierStartCharacter(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// ChangeOp names the kind of a Change
+type ChangeOp string
+
+const (
+	// OpSet is a value being set, or created if Before is nil
+	OpSet ChangeOp = "set"
+	// OpDelete is a key being deleted from a map
+	OpDelete ChangeOp = "delete"
+	// OpSplice is regions of an array being replaced by new items, as done by
+	// MatchSet.MutateRegions or when deleting array items
+	OpSplice ChangeOp = "splice"
+)
+
+// Change describes one change made by a mutation. See MutationOptions.ReportChanges.
+type Change struct {
+	// The jsonmatch path of the changed value, or of the array for splices
+	Path string
+	Op   ChangeOp
+	// The value before and after the change. For splices these hold the removed
+	// and inserted items of each region as [][]interface{}.
+	Before interface{}
+	After  interface{}
+	// For splices, the index ranges removed from the array
+	Removed Regions
+	// For splices, the index ranges of the inserted items in the resulting array
+	Inserted Regions
+}
+
+// report returns the change as a Change
+func (c change) report() Change {
+	switch c.kind {
+	case changeDelete:
+		return Change{Path: formatPath(c.path), Op: OpDelete, Before: c.before}
+	case changeSplice:
+		inserted := make(Regions, 0, len(c.regions))
+		for _, region := range c.regions {
+			if !region.Empty() {
+				inserted = append(inserted, region)
+			}
+		}
+		return Change{
+			Path:     formatPath(c.path),
+			Op:       OpSplice,
+			Before:   c.removed,
+			After:    c.inserted,
+			Removed:  c.replaced,
+			Inserted: inserted,
+		}
+	}
+	return Change{Path: formatPath(c.path), Op: OpSet, Before: c.before, After: c.after}
+}
+
+// memberRef returns a ref to the member of the variable with the key or index
+func memberRef(variable *VarRef, key interface{}) (Ref, error) {
+	switch k := key.(type) {
+	case string:
+		ref, err := NewMapRef(variable, []string{k})
+		if err != nil {
+			return nil, err
+		}
+		return ref, nil
+	case int:
+		ref, err := NewArrayRef(variable, Regions{Region{k, k + 1}})
+		if err != nil {
+			return nil, err
+		}
+		return ref, nil
+	}
+	return nil, fmt.Errorf("Invalid key %v in path of %s", key, variable.id())
+}
+
+// varAtPath returns a VarRef for the value at the path below the variable
+func varAtPath(variable *VarRef, path []interface{}) (*VarRef, error) {
+	for _, key := range path {
+		ref, err := memberRef(variable, key)
+		if err != nil {
+			return nil, err
+		}
+		variable = ref.Vars()[0]
+	}
+	return variable, nil
+}
+
+// revert undoes the change in the document held by the root variable
+func (c change) revert(root *VarRef) error {
+	if c.kind == changeSplice {
+		variable, err := varAtPath(root, c.path)
+		if err != nil {
+			return err
+		}
+		ref, err := NewArrayRef(variable, c.regions)
+		if err != nil {
+			return err
+		}
+		return ref.MutateRegions(func(_ string, _ [][]interface{}) ([][]interface{}, error) {
+			return c.removed, nil
+		})
+	}
+	if len(c.path) == 0 {
+		return root.Set(c.before)
+	}
+	parent, err := varAtPath(root, c.path[:len(c.path)-1])
+	if err != nil {
+		return err
+	}
+	ref, err := memberRef(parent, c.path[len(c.path)-1])
+	if err != nil {
+		return err
+	}
+	if !c.existed {
+		return ref.Delete()
+	}
+	return ref.Set(c.before)
+}
+
+// InversePatch reverts the mutations made through a MatchSet. See
+// MutationOptions.RecordInverse.
+type InversePatch struct {
+	changes []change
+}
+
+// Apply reverts the mutations in the document they produced, returning the document
+// exactly as it was before them. The provided document is not modified.
+func (p *InversePatch) Apply(doc interface{}) (interface{}, error) {
+	root := newRootVar(doc)
+	root.beginMutation(false)
+	defer root.endMutation()
+	for i := len(p.changes) - 1; i >= 0; i-- {
+		if err := p.changes[i].revert(root); err != nil {
+			return nil, err
+		}
+	}
+	return root.Value(), nil
+}
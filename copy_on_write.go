@@ -0,0 +1,120 @@
+package jsonmatch
+
+import "reflect"
+
+// ownership tracks the containers created by the mutation in progress. These are
+// not shared with the input document or with any document returned earlier, so
+// the rest of the mutation may modify them in place. This way each container on
+// the path to a changed value is copied at most once per mutation, rather than
+// once for every value changed inside it.
+type ownership struct {
+	// Every container is owned, used when the caller owns the document
+	inPlace bool
+	// The containers created by the mutation, by the address of their storage. The
+	// containers are held on to, so their storage is never reused for other values
+	// while the mutation is in progress.
+	owned map[uintptr]interface{}
+}
+
+// storage returns the address of the storage of a map or a non-empty slice. Empty
+// slices have no storage of their own, and are never modified in place.
+func storage(container interface{}) (uintptr, bool) {
+	value := reflect.ValueOf(container)
+	switch value.Kind() {
+	case reflect.Map:
+		return value.Pointer(), !value.IsNil()
+	case reflect.Slice:
+		return value.Pointer(), value.Len() > 0
+	}
+	return 0, false
+}
+
+// beginMutation starts tracking the containers created by a mutation of the
+// document. If inPlace is true, the document is modified rather than copied.
+func (r *VarRef) beginMutation(inPlace bool) {
+	r.root().owner = &ownership{inPlace: inPlace, owned: map[uintptr]interface{}{}}
+}
+
+// endMutation stops tracking containers. Containers created by the mutation are
+// part of the resulting document now, and must not be modified any more.
+func (r *VarRef) endMutation() {
+	r.root().owner = nil
+}
+
+// own marks a container created by the mutation in progress as owned by it
+func (r *VarRef) own(container interface{}) {
+	owner := r.root().owner
+	if owner == nil {
+		return
+	}
+	if address, ok := storage(container); ok {
+		owner.owned[address] = container
+	}
+}
+
+// owns is true if the canonical value of the variable may be modified in place.
+// This requires the canonical value to share storage with the actual value of the
+// variable, and that storage to be owned by the mutation in progress.
+func (r *VarRef) owns(canonical interface{}) bool {
+	owner := r.root().owner
+	if owner == nil {
+		return false
+	}
+	address, ok := storage(canonical)
+	if !ok {
+		return false
+	}
+	if actual, _ := storage(r.Value()); actual != address {
+		return false
+	}
+	if owner.inPlace {
+		return true
+	}
+	_, owned := owner.owned[address]
+	return owned
+}
+
+// mutableSlice returns the slice held by the variable ready to be modified. Unless
+// the mutation in progress owns the slice, it is a copy and fresh is true to tell
+// that it must be written to the variable when done.
+func (r *VarRef) mutableSlice() (slice []interface{}, fresh bool, err error) {
+	current, err := r.canonicalSlice()
+	if err != nil {
+		return nil, false, err
+	}
+	if r.owns(current) {
+		return current, false, nil
+	}
+	slice = make([]interface{}, len(current))
+	copy(slice, current)
+	r.own(slice)
+	return slice, true, nil
+}
+
+// mutableMap returns the map held by the variable ready to be modified. Unless
+// the mutation in progress owns the map, it is a copy and fresh is true to tell
+// that it must be written to the variable when done.
+func (r *VarRef) mutableMap() (m map[string]interface{}, fresh bool, err error) {
+	current, err := r.canonicalMap()
+	if err != nil {
+		return nil, false, err
+	}
+	if r.owns(current) {
+		return current, false, nil
+	}
+	m = make(map[string]interface{}, len(current))
+	for k, v := range current {
+		m[k] = v
+	}
+	r.own(m)
+	return m, true, nil
+}
+
+// commit writes a container returned by mutableSlice or mutableMap to the
+// variable, unless it was modified in place
+func (r *VarRef) commit(container interface{}, fresh bool) error {
+	if !fresh {
+		return nil
+	}
+	return r.writeWithMatchedType(container)
+}
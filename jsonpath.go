@@ -1,5 +1,10 @@
 package jsonmatch
 
+import (
+	"fmt"
+	"sort"
+)
+
 // Match compiles and excutes the jsonmatch expression on the underlying
 // data
 func Match(path string, data interface{}) (*MatchSet, error) {
@@ -9,3 +14,127 @@ func Match(path string, data interface{}) (*MatchSet, error) {
 	}
 	return expr.Match(data)
 }
+
+// Get returns the value matched by path in the document, and whether there was
+// one. If the path matches several values, the first is returned as by
+// Expression.First. Simple paths of plain field names and integer indicies, as
+// in `a.b[3].c`, are looked up directly without evaluating a full expression.
+func Get(doc interface{}, path string) (interface{}, bool, error) {
+	if keys, simple := parseSimplePath(path); simple {
+		if value, found, ok := getSimplePath(doc, keys); ok {
+			return value, found, nil
+		}
+	}
+	expr, err := Parse(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return expr.First(doc)
+}
+
+// Set sets the values matched by path in the document, as done by MatchSet.Set,
+// and returns the resulting document. Like Get, simple paths are handled
+// directly where the document allready holds the containers along the path.
+func Set(doc interface{}, path string, value interface{}) (interface{}, error) {
+	if keys, simple := parseSimplePath(path); simple && assertIsCompatible(value) == nil {
+		if result, ok := setSimplePath(doc, keys, value); ok {
+			return result, nil
+		}
+	}
+	ms, err := Match(path, doc)
+	if err != nil {
+		return nil, err
+	}
+	return ms.Set(value)
+}
+
+// ApplyDefaults fills in default values for any paths that are missing or nil
+// in the document. The keys of defaults are jsonmatch expressions. They are
+// applied in sorted order, so a default for "meta" is in place before the one
+// for "meta.tags" is considered.
+func ApplyDefaults(doc interface{}, defaults map[string]interface{}) (interface{}, error) {
+	paths := make([]string, 0, len(defaults))
+	for path := range defaults {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		ms, err := Match(path, doc)
+		if err != nil {
+			return nil, err
+		}
+		doc, err = ms.SetIfMissing(defaults[path])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Copy copies the value matched by the from expression to the location matched
+// by the to expression, creating any missing paths the way Set does. The from
+// expression must match exactly one value, which is deep copied so the copy shares
+// no maps or slices with the source. If anything fails, the document is
+// returned unchanged along with the error.
+func Copy(doc interface{}, from, to string) (interface{}, error) {
+	source, err := Match(from, doc)
+	if err != nil {
+		return doc, err
+	}
+	value, err := singleValue(from, source)
+	if err != nil {
+		return doc, err
+	}
+	// The copy must not share its maps and slices with the source
+	result, err := setTarget(doc, to, deepCopy(value))
+	if err != nil {
+		return doc, err
+	}
+	return result, nil
+}
+
+// Move moves the value matched by the from expression to the location matched by
+// the to expression. The value is removed before the to expression is resolved,
+// so array indicies in it refer to positions after the removal. If anything fails,
+// the document is returned unchanged along with the error.
+func Move(doc interface{}, from, to string) (interface{}, error) {
+	source, err := Match(from, doc)
+	if err != nil {
+		return doc, err
+	}
+	value, err := singleValue(from, source)
+	if err != nil {
+		return doc, err
+	}
+	removed, err := source.Delete()
+	if err != nil {
+		return doc, err
+	}
+	result, err := setTarget(removed, to, value)
+	if err != nil {
+		return doc, err
+	}
+	return result, nil
+}
+
+// singleValue returns the value of a MatchSet that must match exactly one value
+func singleValue(path string, ms *MatchSet) (interface{}, error) {
+	values := ms.Values()
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%q must match exactly one value, matched %d", path, len(values))
+	}
+	return values[0], nil
+}
+
+// setTarget sets the value at all locations matched by path, failing if there
+// is no such location and none can be created.
+func setTarget(doc interface{}, path string, value interface{}) (interface{}, error) {
+	target, err := Match(path, doc)
+	if err != nil {
+		return nil, err
+	}
+	if !isAddressable(target.ref) {
+		return nil, fmt.Errorf("%q does not match any location that can be set", path)
+	}
+	return target.Set(value)
+}
@@ -0,0 +1,105 @@
+package jsonmatch
+
+import (
+	"context"
+	"fmt"
+)
+
+// MatchOptions bound the work done by MatchContext. Zero values mean no limit.
+type MatchOptions struct {
+	// MaxDepth is the deepest level of nesting below the root that may be visited
+	MaxDepth int
+	// MaxNodes is the maximum number of values that may be visited
+	MaxNodes int
+	// MaxResults is the maximum number of values that may be matched
+	MaxResults int
+}
+
+// LimitError is returned by MatchContext when matching exceeds one of the limits
+// of the MatchOptions
+type LimitError struct {
+	// The name of the exceeded limit, as in "MaxNodes"
+	Limit string
+	// The value of the limit
+	Max int
+	// The path of the value where the limit was exceeded
+	Path string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Exceeded %s limit of %d at %s", e.Limit, e.Max, e.Path)
+}
+
+// How many values are visited between checks of the context
+const contextCheckInterval = 64
+
+// evaluation tracks the work done by a match against its limits
+type evaluation struct {
+	ctx     context.Context
+	options MatchOptions
+	visited int
+	// Set when the match is complete, since the variables of the MatchSet are
+	// used by its mutations later on
+	done bool
+}
+
+// MatchContext runs the jsonmatch query on the data like Match, but stops with the
+// error of the context if it is done, or with a *LimitError if any of the limits
+// of the options are exceeded.
+func (expr *Expression) MatchContext(ctx context.Context, data interface{}, options MatchOptions) (*MatchSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rootVar := newRootVar(data)
+	e := &evaluation{ctx: ctx, options: options}
+	rootVar.evaluation = e
+	ref, err := expr.evaluate(rootVar)
+	e.done = true
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxResults > 0 && ref.EstimateSize() > options.MaxResults {
+		return nil, &LimitError{Limit: "MaxResults", Max: options.MaxResults, Path: rootVar.id()}
+	}
+	return &MatchSet{
+		root: rootVar,
+		ref:  ref,
+	}, nil
+}
+
+// limitsVisits is true if the evaluation limits the values that may be visited
+func (e *evaluation) limitsVisits() bool {
+	return e != nil && (e.options.MaxNodes > 0 || e.options.MaxDepth > 0)
+}
+
+// visit accounts for the variable being visited by the match in progress, and
+// returns an error if the match must stop
+func (r *VarRef) visit() error {
+	e := r.evaluation
+	if e == nil || e.done {
+		return nil
+	}
+	e.visited++
+	if e.visited%contextCheckInterval == 0 {
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if max := e.options.MaxNodes; max > 0 && e.visited > max {
+		return &LimitError{Limit: "MaxNodes", Max: max, Path: r.id()}
+	}
+	if max := e.options.MaxDepth; max > 0 && r.nesting(max+1) > max {
+		return &LimitError{Limit: "MaxDepth", Max: max, Path: r.id()}
+	}
+	return nil
+}
+
+// nesting returns the number of containers holding the variable, counting no
+// further than max
+func (r *VarRef) nesting(max int) int {
+	result := 0
+	for v := r.parent; v != nil && result < max; v = v.parent {
+		result++
+	}
+	return result
+}
@@ -1,37 +1,193 @@
 package jsonmatch
 
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"sync"
 
 	"github.com/sanity-io/jsonmatch/template"
 )
 
 // Match runs the jsonmatch query on the data and returns a MatchSet
-// referencing all matches
+// referencing all matches. Match may be called from several goroutines at once,
+// also with the same data.
 func (expr *Expression) Match(data interface{}) (*MatchSet, error) {
-	// Setup the root VarRef
+	rootVar := newRootVar(data)
+	ref, err := expr.evaluate(rootVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MatchSet{
+		root: rootVar,
+		ref:  ref,
+	}, nil
+}
+
+// MatchWithOptions runs the jsonmatch query on the data and returns a MatchSet
+// using the options for its mutations. See MatchSet.WithOptions.
+func (expr *Expression) MatchWithOptions(data interface{}, options MutationOptions) (*MatchSet, error) {
+	ms, err := expr.Match(data)
+	if err != nil {
+		return nil, err
+	}
+	return ms.WithOptions(options), nil
+}
+
+// MatchResult is the outcome of matching one document of a batch
+type MatchResult struct {
+	MatchSet *MatchSet
+	Err      error
+}
+
+// MatchAll matches the expression against each of the documents in parallel, using
+// at most workers goroutines, or one per CPU if workers is not positive. The
+// results are returned in the order of the documents. If the context is done
+// before every document has been matched, the documents being matched and the
+// remaining ones get the error of the context as their result, and that error is
+// returned as well.
+func (expr *Expression) MatchAll(ctx context.Context, docs []interface{}, workers int) ([]MatchResult, error) {
+	results := make([]MatchResult, len(docs))
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(docs) {
+		workers = len(docs)
+	}
+	indicies := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indicies {
+				if err := ctx.Err(); err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i].MatchSet, results[i].Err = expr.MatchContext(ctx, docs[i], MatchOptions{})
+			}
+		}()
+	}
+	for i := range docs {
+		indicies <- i
+	}
+	close(indicies)
+	wg.Wait()
+	for _, result := range results {
+		if result.Err != nil && result.Err == ctx.Err() {
+			return results, result.Err
+		}
+	}
+	return results, nil
+}
+
+// evaluate evaluates the expression against the input using its compiled plan
+func (expr *Expression) evaluate(input Ref) (Ref, error) {
+	if expr.plan == nil {
+		// Not made by the parser
+		return process(input, expr.root)
+	}
+	return expr.plan(input)
+}
+
+// newRootVar returns a VarRef holding the whole document. Setting it replaces the
+// document held by the VarRef, never the value passed in.
+func newRootVar(data interface{}) *VarRef {
 	getter := func() interface{} {
 		return data
 	}
-	setter := func(value interface{}) {
+	setter := func(value interface{}) error {
 		data = value
+		return nil
 	}
-	rootVar := &VarRef{
+	return &VarRef{
 		identity: "$",
 		setter:   setter,
 		getter:   getter,
 	}
+}
 
-	ref, err := process(rootVar, expr.root)
-	if err != nil {
-		return nil, err
+// holds tests the expression as a predicate against the data. An expression that
+// consists only of filters, as in `[rev == 3]`, is tested against the data itself,
+// so `@` refers to the data. Any other expression holds if it matches at least one
+// value.
+func (expr *Expression) holds(data interface{}) (bool, error) {
+	filters, ok := predicateFilters(expr.root)
+	if !ok {
+		ms, err := expr.Match(data)
+		if err != nil {
+			return false, err
+		}
+		return len(ms.Values()) > 0, nil
+	}
+	self := newRootVar(data)
+	for _, filter := range filters {
+		isMatch, err := testFilter(self, filter)
+		if err != nil || isMatch {
+			return isMatch, err
+		}
 	}
+	return false, nil
+}
 
-	return &MatchSet{
-		root:    rootVar,
-		ref:     ref,
-		mutated: false,
-	}, nil
+// predicateFilters returns the filters of an expression consisting only of filters
+func predicateFilters(n node) ([]*filterNode, bool) {
+	switch t := n.(type) {
+	case *filterNode:
+		return []*filterNode{t}, true
+	case *pathNode:
+		if len(t.nodes) == 1 {
+			return predicateFilters(t.nodes[0])
+		}
+	case *unionNode:
+		var filters []*filterNode
+		for _, member := range t.nodes {
+			memberFilters, ok := predicateFilters(member)
+			if !ok {
+				return nil, false
+			}
+			filters = append(filters, memberFilters...)
+		}
+		return filters, len(filters) > 0
+	}
+	return nil, false
+}
+
+// testedPaths returns the paths of the values in the data compared by the filters
+// of a predicate consisting only of filters, or nil for any other predicate
+func (expr *Expression) testedPaths(data interface{}) ([]string, error) {
+	filters, ok := predicateFilters(expr.root)
+	if !ok {
+		return nil, nil
+	}
+	self := newRootVar(data)
+	var paths []string
+	for _, filter := range filters {
+		for _, operand := range []node{filter.lhs, filter.rhs} {
+			if operand == nil {
+				continue
+			}
+			result, err := process(self, operand)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range individualRefs(result) {
+				switch t := r.(type) {
+				case *LiteralRef:
+					continue
+				case *LatentMapRef:
+					paths = append(paths, t.identities()...)
+				default:
+					for _, v := range r.Vars() {
+						paths = append(paths, v.id())
+					}
+				}
+			}
+		}
+	}
+	return paths, nil
 }
 
 func process(input Ref, root node) (Ref, error) {
@@ -73,37 +229,50 @@ func process(input Ref, root node) (Ref, error) {
 func processPath(input Ref, list *pathNode) (Ref, error) {
 	var err error
 	result := input
-	for _, n := range list.nodes {
+	for i, n := range list.nodes {
 		result, err = process(result, n)
 		if err != nil {
 			return nil, err
 		}
+		if i > 0 {
+			if _, afterRecursive := list.nodes[i-1].(*recursiveNode); afterRecursive {
+				// Never offer to create missing values in every container of the document
+				result = withoutLatentRefs(result)
+			}
+		}
 	}
 	return result, nil
 }
 
 // processField evaluates field of struct or key of map.
 func processFieldSelection(input Ref, name string, requireFieldToExist bool) (Ref, error) {
-	results := NewEmptyRef()
+	var results []Ref
+	// Shared by the refs made, as refs never modify their keys
+	keys := []string{name}
 	for _, varRef := range input.Vars() {
+		if err := varRef.visit(); err != nil {
+			return nil, err
+		}
 		if varRef.IsMap() {
+			value, err := varRef.canonicalMap()
+			if err != nil {
+				return nil, err
+			}
 			// If field must be pre-existing, we check that here and potantially reject the match
 			if requireFieldToExist {
-				value := varRef.CanonicalValue().(map[string]interface{})
 				if _, hasField := value[name]; !hasField {
 					continue
 				}
 			}
-			results = results.Union(NewMapRef(varRef, []string{name}))
+			results = append(results, newMapRef(varRef, keys))
 		}
 	}
 	if !requireFieldToExist {
 		for _, latent := range latentMapRefs(input) {
-			latent.AddKey(name)
-			results = results.Union(latent)
+			results = append(results, latent.withSegment(latentSegment{kind: latentKey, key: name}))
 		}
 	}
-	return results, nil
+	return NewUnionRef(results...), nil
 }
 
 func processField(input Ref, node *fieldNode) (Ref, error) {
@@ -114,124 +283,265 @@ func processExistingField(input Ref, node *existingFieldNode) (Ref, error) {
 	return processFieldSelection(input, node.name, true)
 }
 
+// regions returns the regions of an array of the given length selected by the slice
+func (node *sliceNode) regions(length int) Regions {
+	return newSliceBounds(node).regions(length)
+}
+
+// sliceBounds are the start, end and step of a slice with the defaults applied
+type sliceBounds struct {
+	start          int
+	startSpecified bool
+	end            int
+	endSpecified   bool
+	step           int
+}
+
+func newSliceBounds(node *sliceNode) sliceBounds {
+	bounds := sliceBounds{startSpecified: node.startSpecified, endSpecified: node.endSpecified, step: 1}
+	if node.startSpecified {
+		bounds.start = node.start
+	}
+	if node.endSpecified {
+		bounds.end = node.end
+	}
+	if node.stepSpecified {
+		bounds.step = node.step
+	}
+	return bounds
+}
+
+// regions returns the regions of an array of the given length within the bounds
+func (bounds sliceBounds) regions(length int) Regions {
+	if bounds.step < 0 {
+		return bounds.reverseRegions(length)
+	}
+	start := bounds.start
+	if start < 0 {
+		start += length
+	}
+	end := length
+	if bounds.endSpecified {
+		end = bounds.end
+	}
+	if end < 0 {
+		end += length
+	}
+
+	// Clamp start/end to edges of array
+	if start < 0 {
+		start = 0
+	}
+	if end > length {
+		end = length
+	}
+
+	step := bounds.step
+	if step == 0 {
+		// She didn't mean that, right? We'll try to make sense of it
+		if end != start {
+			end = start + 1
+		}
+		step = 1
+	}
+
+	if start > length {
+		start = length
+	}
+	if end < start {
+		// Selects nothing, but still locates a position to insert at
+		end = start
+	}
+	if step == 1 {
+		// This is a continuous range e.g. "4:7" "5:"
+		return Regions{Region{start, end}}
+	}
+	// This is discontinuous, so need to make individual indicies
+	if end == start {
+		return Regions{}
+	}
+	// Build array of indicies
+	indicies := make([]int, 0, (end-start-1)/step+1)
+	for i := start; i < end; i += step {
+		indicies = append(indicies, i)
+	}
+	return NewRegionForEachIndex(indicies)
+}
+
+// reverseRegions returns the regions of a slice stepping backwards from start down
+// to, but not including, end. `[5:2:-1]` selects the items at 5, 4 and 3. Without
+// a start the slice begins at the last item, and without an end it runs through
+// the first item.
+func (bounds sliceBounds) reverseRegions(length int) Regions {
+	start := length - 1
+	if bounds.startSpecified {
+		start = bounds.start
+		if start < 0 {
+			start += length
+		}
+		if start > length-1 {
+			start = length - 1
+		}
+	}
+	end := -1
+	if bounds.endSpecified {
+		end = bounds.end
+		if end < 0 {
+			end += length
+		}
+		if end < -1 {
+			end = -1
+		}
+	}
+	if start <= end {
+		return Regions{}
+	}
+	indicies := make([]int, (start-end-1)/-bounds.step+1)
+	// Regions are in ascending order, so the last index stepped to comes first
+	for i := range indicies {
+		indicies[len(indicies)-1-i] = start + i*bounds.step
+	}
+	return NewRegionForEachIndex(indicies)
+}
+
 // evalArray evaluates sliceNode
 func processSlice(input Ref, node *sliceNode) (Ref, error) {
-	result := NewEmptyRef()
+	return sliceItems(input, newSliceBounds(node))
+}
+
+// sliceItems matches the items within the bounds of the arrays of the input
+func sliceItems(input Ref, bounds sliceBounds) (Ref, error) {
+	var result []Ref
 	for _, varRef := range input.Vars() {
+		if err := varRef.visit(); err != nil {
+			return nil, err
+		}
 		if varRef.IsSlice() {
-			value := varRef.CanonicalValue().([]interface{})
-			// Extract the start, end and step values
-			start := 0
-			if node.startSpecified {
-				start = node.start
-			}
-			if start < 0 {
-				start += len(value)
-			}
-			end := len(value)
-			if node.endSpecified {
-				end = node.end
-			}
-			if end < 0 {
-				end += len(value)
-			}
-
-			// Clamp start/end to edges of array
-			if start < 0 {
-				start = 0
-			}
-			if end > len(value) {
-				end = len(value)
-			}
-
-			step := 1
-			if node.stepSpecified {
-				step = node.step
-				if step == 0 {
-					// She didn't mean that, right? We'll try to make sense of it
-					if end != start {
-						end = start + 1
-					}
-					step = 1
-				}
-			}
-
-			if step == 1 {
-				// This is a continuous range e.g. "4:7" "5:"
-				result = result.Union(NewArrayRef(varRef, Regions{Region{start, end}}))
-			} else {
-				// This is discontinuous, or reverse, so need to make individual indicies
-				if step < 0 {
-					start, end = end, start
-				}
-				// Build array of indicies
-				indicies := make([]int, 0, end-start)
-				for i := start; i < end; i += step {
-					indicies = append(indicies, i)
-				}
-				result = result.Union(NewArrayRef(varRef, NewRegionForEachIndex(indicies)))
+			value, err := varRef.canonicalSlice()
+			if err != nil {
+				return nil, err
 			}
+			result = append(result, newArrayRef(varRef, bounds.regions(len(value))))
 		}
 	}
-	return result, nil
+	return NewUnionRef(result...), nil
 }
 
 func processIndex(input Ref, node *indexNode) (Ref, error) {
-	result := NewEmptyRef()
+	var result []Ref
 	for _, varRef := range input.Vars() {
+		if err := varRef.visit(); err != nil {
+			return nil, err
+		}
 		if varRef.IsSlice() {
-			value := varRef.CanonicalValue().([]interface{})
+			value, err := varRef.canonicalSlice()
+			if err != nil {
+				return nil, err
+			}
 			index := node.value
 			if len(value) == 0 && (node.value == 0 || node.value == -1) {
 				// Special handling of index 0 (start of array) and -1 (end of array)
 				// when length is 0. We return a zero length selection in order to support
 				// seamless appending/prepending to arrays even when they are empty.
-				result = result.Union(NewArrayRef(varRef, Regions{Region{0, 0}}))
+				result = append(result, newArrayRef(varRef, Regions{Region{0, 0}}))
+				// Setting the item will insert it
+				result = append(result, newLatentItemRef(newArrayRef(varRef, Regions{Region{0, 0}}),
+					latentSegment{kind: latentIndex}))
 			} else {
 				if index < 0 {
 					index += len(value)
 				}
 				// ignore indicies outside the range of the array
 				if index >= 0 && index < len(value) {
-					result = result.Union(NewArrayRef(varRef, Regions{Region{index, index + 1}}))
+					result = append(result, newArrayRef(varRef, Regions{Region{index, index + 1}}))
 				}
 			}
 		}
 	}
-	return result, nil
+	if node.value == 0 || node.value == -1 {
+		// Missing arrays are created with a single item when set
+		for _, latent := range latentMapRefs(input) {
+			if extended := latent.withSegment(latentSegment{kind: latentIndex}); extended != nil {
+				result = append(result, extended)
+			}
+		}
+	}
+	return NewUnionRef(result...), nil
 }
 
 func processWildcard(input Ref, node *wildcardNode) (Ref, error) {
-	result := NewEmptyRef()
+	var result []Ref
 	for _, varRef := range input.Vars() {
-		result = result.Union(matchAllChildren(varRef))
+		if err := varRef.visit(); err != nil {
+			return nil, err
+		}
+		children, err := matchAllChildren(varRef)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, children)
 	}
-	return result, nil
+	return NewUnionRef(result...), nil
 }
 
+// processRecursive evaluates recursiveNode, matching the input along with all its
+// descendants within the depth bounds of the node. The document is traversed
+// once, depth first in document order, keeping the containers still to be
+// visited on a stack rather than recursing.
 func processRecursive(input Ref, node *recursiveNode) (Ref, error) {
-	result := input
-	for _, varRef := range input.Vars() {
-		children := matchAllChildren(varRef)
-		descendants, err := processRecursive(children, node)
+	var result []Ref
+	if node.minDepth == 0 {
+		result = append(result, input)
+	}
+	type pending struct {
+		variable *VarRef
+		// The level of nesting below the input
+		level int
+	}
+	vars := input.Vars()
+	stack := make([]pending, 0, len(vars))
+	for i := len(vars) - 1; i >= 0; i-- {
+		stack = append(stack, pending{vars[i], 0})
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if err := current.variable.visit(); err != nil {
+			return nil, err
+		}
+		if !current.variable.IsMap() && !current.variable.IsSlice() {
+			continue
+		}
+		children, err := matchAllChildren(current.variable)
 		if err != nil {
 			return nil, err
 		}
-		result = result.Union(descendants)
+		level := current.level + 1
+		if level >= node.minDepth {
+			result = append(result, children)
+		}
+		if node.maxDepthSpecified && level >= node.maxDepth {
+			continue
+		}
+		// Pushed in reverse so the first child is visited next
+		childVars := children.Vars()
+		for i := len(childVars) - 1; i >= 0; i-- {
+			stack = append(stack, pending{childVars[i], level})
+		}
 	}
-	return result, nil
+	return NewUnionRef(result...), nil
 }
 
 func processUnion(input Ref, n *unionNode) (Ref, error) {
-	result := NewEmptyRef()
+	var result []Ref
 	for _, pathNode := range n.nodes {
 		subset, err := process(input, pathNode)
 		if err != nil {
 			return nil, err
 		}
-		result = result.Union(subset)
+		result = append(result, subset)
 	}
-	return result, nil
+	return NewUnionRef(result...), nil
 }
 
 func coerceComparisionValue(value interface{}) interface{} {
@@ -290,28 +600,78 @@ func applyFilter(lhs Ref, rhs Ref, node *filterNode) (bool, error) {
 	return result, err
 }
 
+// testFilter evaluates the filter condition with the candidate as `@`
+func testFilter(candidate Ref, node *filterNode) (bool, error) {
+	lhs, err := process(candidate, node.lhs)
+	if err != nil {
+		return false, err
+	}
+	var rhs Ref
+	// unary operators have no rhs
+	if node.rhs != nil {
+		rhs, err = process(candidate, node.rhs)
+		if err != nil {
+			return false, err
+		}
+	}
+	return applyFilter(lhs, rhs, node)
+}
+
 func processFilter(input Ref, node *filterNode) (Ref, error) {
-	result := NewEmptyRef()
+	return filterChildren(input, node, func(candidate filterCandidate) (bool, error) {
+		return testFilter(candidate.ref(), node)
+	})
+}
+
+// filterCandidate is a child of a container tested by a filter. The ref to it is
+// only made if the test needs it.
+type filterCandidate struct {
+	parent *VarRef
+	inMap  bool
+	key    string
+	index  int
+	// The value of the child in the canonical container
+	value interface{}
+}
+
+// ref returns a ref to the candidate
+func (c filterCandidate) ref() Ref {
+	if c.inMap {
+		return newMapRef(c.parent, []string{c.key})
+	}
+	return newArrayRef(c.parent, Regions{Region{c.index, c.index + 1}})
+}
+
+// filterChildren matches the children of the input that pass the test of the filter
+func filterChildren(input Ref, node *filterNode, test func(filterCandidate) (bool, error)) (Ref, error) {
+	var result []Ref
+	// Filters on the form [_key == "literal"] will create the item if it is missing
+	keyedItem, upsert := keyedItemSegment(node)
+	if upsert {
+		for _, latent := range latentMapRefs(input) {
+			if extended := latent.withSegment(keyedItem); extended != nil {
+				result = append(result, extended)
+			}
+		}
+	}
 	// Now go through each entry in the result and check conditions
 	for _, varRef := range input.Vars() {
+		if err := varRef.visit(); err != nil {
+			return nil, err
+		}
 		if varRef.IsMap() {
-			mapRef := matchAllChildren(varRef).(*MapRef)
-			matches := make([]string, 0, len(mapRef.keys))
-			for _, key := range mapRef.keys {
-				// Get the lhs for this key
-				lhs, err := process(NewMapRef(mapRef.variable, []string{key}), node.lhs)
-				if err != nil {
+			value, err := varRef.canonicalMap()
+			if err != nil {
+				return nil, err
+			}
+			keys := allKeysOfMap(value)
+			matches := make([]string, 0, len(keys))
+			for _, key := range keys {
+				// Each candidate counts as a visit, as testing it may not visit anything else
+				if err := varRef.visit(); err != nil {
 					return nil, err
 				}
-				var rhs Ref
-				// unary operators have no rhs
-				if node.rhs != nil {
-					rhs, err = process(NewMapRef(mapRef.variable, []string{key}), node.rhs)
-					if err != nil {
-						return nil, err
-					}
-				}
-				isMatch, err := applyFilter(lhs, rhs, node)
+				isMatch, err := test(filterCandidate{parent: varRef, inMap: true, key: key, value: value[key]})
 				if err != nil {
 					return nil, err
 				}
@@ -319,25 +679,19 @@ func processFilter(input Ref, node *filterNode) (Ref, error) {
 					matches = append(matches, key)
 				}
 			}
-			result = result.Union(NewMapRef(mapRef.variable, matches))
+			result = append(result, newMapRef(varRef, matches))
 		} else if varRef.IsSlice() {
-			arrayRef := matchAllChildren(varRef).(*ArrayRef)
-			matches := make([]int, 0, arrayRef.EstimateSize())
-			for _, index := range arrayRef.selection.ToIndicies() {
-				// Get the lhs for this key
-				lhs, err := process(NewArrayRef(arrayRef.variable, NewRegionForEachIndex([]int{index})), node.lhs)
-				if err != nil {
+			value, err := varRef.canonicalSlice()
+			if err != nil {
+				return nil, err
+			}
+			matches := make([]int, 0, len(value))
+			for index, item := range value {
+				// Each candidate counts as a visit, as testing it may not visit anything else
+				if err := varRef.visit(); err != nil {
 					return nil, err
 				}
-				var rhs Ref
-				// unary operators have no rhs
-				if node.rhs != nil {
-					rhs, err = process(NewArrayRef(arrayRef.variable, NewRegionForEachIndex([]int{index})), node.rhs)
-					if err != nil {
-						return nil, err
-					}
-				}
-				isMatch, err := applyFilter(lhs, rhs, node)
+				isMatch, err := test(filterCandidate{parent: varRef, index: index, value: item})
 				if err != nil {
 					return nil, err
 				}
@@ -345,8 +699,12 @@ func processFilter(input Ref, node *filterNode) (Ref, error) {
 					matches = append(matches, index)
 				}
 			}
-			result = result.Union(NewArrayRef(arrayRef.variable, NewRegionForEachIndex(matches)))
+			result = append(result, newArrayRef(varRef, NewRegionForEachIndex(matches)))
+			if upsert && len(matches) == 0 {
+				end := len(value)
+				result = append(result, newLatentItemRef(newArrayRef(varRef, Regions{Region{end, end}}), keyedItem))
+			}
 		}
 	}
-	return result, nil
+	return NewUnionRef(result...), nil
 }
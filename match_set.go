@@ -1,69 +1,337 @@
 package jsonmatch
 
 import (
-	"errors"
 	"fmt"
+	"strings"
 )
 
 // MatchSet represents one jsonmatch extract and provides functions for
-// mutating or extracting the matched values. Setting selected values can
-// be done until you have performed a mutation. You can only perform exactly
-// one mutation.
+// mutating or extracting the matched values. Any number of mutations may be
+// performed in sequence. The MatchSet keeps track of the matched values as
+// they are mutated, so Values always reflect the latest state:
+//
+//   - After Set and Mutate, paths that did not exist refer to the created values.
+//   - After Delete, the MatchSet refers to nothing since the values are gone.
+//   - After MutateRegions, the selections cover the replacement items. Matches
+//     nested inside the replaced array regions are dropped.
+//   - Matches inside values that have since been replaced by something that
+//     can not contain them are dropped.
+//
+// Mutations never modify the document that was matched, nor any document
+// returned by an earlier mutation. Every map and slice holding a changed value
+// is copied, while the parts of the document that did not change are shared
+// between the input and the result. A result may therefore change if the
+// caller modifies the input directly, but never because of a mutation. The
+// DeepCopy option makes the results share nothing with the input, and the
+// InPlace option lifts the guarantee for callers who own the document.
 type MatchSet struct {
 	// The variable reference containing the root value of the extract
 	root *VarRef
 	// The ref describing the matched values of the extract
 	ref Ref
-	// True if the underlying value has been mutated
-	mutated bool
+	// Options for the mutations
+	options MutationOptions
+}
+
+// MutationOptions control how the mutations of a MatchSet are performed
+type MutationOptions struct {
+	// RecordInverse records the prior value of everything that is changed, so the
+	// mutations can be reverted using the patch returned by MatchSet.Inverse
+	RecordInverse bool
+	// ReportChanges records every change made, so they can be reviewed using
+	// MatchSet.Changes
+	ReportChanges bool
+	// DryRun performs the mutations only to report the changes they would make.
+	// The mutations return the document unchanged, and the MatchSet keeps
+	// referring to the values it matched before.
+	DryRun bool
+	// ErrorPolicy decides what Mutate does when the mutator fails for some of
+	// the values
+	ErrorPolicy ErrorPolicy
+	// Observer is notified of every container the mutations rewrite, once the
+	// mutation is complete. Nothing is reported for mutations that are rolled back
+	// or made in dry-run mode.
+	Observer ContainerObserver
+	// InPlace modifies the maps and slices of the document directly instead of
+	// copying the ones that change. Only use it when the caller owns the document
+	// and nothing else refers to it. Containers modified in place are not reported
+	// to the Observer. InPlace has no effect in dry-run mode or with the
+	// RollbackOnError policy, which need the original document to be left intact.
+	InPlace bool
+	// DeepCopy makes the mutations return a deep copy of the resulting document,
+	// sharing no maps or slices with the input or with the values provided to
+	// the mutations. The maps and slices of the copy have the canonical types.
+	DeepCopy bool
+}
+
+// ErrorPolicy decides what happens when a mutator fails for some of the values
+type ErrorPolicy int
+
+const (
+	// AbortOnError stops the mutation at the first error
+	AbortOnError ErrorPolicy = iota
+	// ApplyValid passes every value through the mutator and applies the results
+	// that succeeded. The values that failed are left unchanged, and their errors
+	// are returned as a *MultiError along with the resulting document.
+	ApplyValid
+	// RollbackOnError passes every value through the mutator, but changes nothing
+	// if any of them failed. The errors are returned as a *MultiError.
+	RollbackOnError
+)
+
+// PathError is an error concerning the value at a specific path
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError holds the errors of all the paths that failed in a mutation
+type MultiError struct {
+	Errors []*PathError
+}
+
+func (e *MultiError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d paths failed: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// ConflictError is returned by conditional mutations when the current values
+// do not match what was expected. Nothing is changed when this happens.
+type ConflictError struct {
+	// The paths of the values that did not match
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Conflicting values at %s", strings.Join(e.Paths, ", "))
+}
+
+// WithOptions sets the options used by subsequent mutations of the MatchSet
+func (e *MatchSet) WithOptions(options MutationOptions) *MatchSet {
+	e.options = options
+	if !options.RecordInverse && !options.ReportChanges && !options.DryRun {
+		e.root.journal = nil
+	} else if e.root.journal == nil {
+		e.root.journal = &journal{}
+	}
+	e.root.observer = nil
+	if options.Observer != nil {
+		e.root.observer = &observer{callback: options.Observer}
+	}
+	return e
+}
+
+// Inverse returns a patch that reverts all mutations made through the MatchSet
+// since RecordInverse was enabled. Applied to the latest result, it restores the
+// document as it was, including the positions of array items. Mutations made in
+// dry-run mode left nothing to revert and are not part of the patch. Returns nil
+// if RecordInverse is not enabled.
+func (e *MatchSet) Inverse() *InversePatch {
+	if !e.options.RecordInverse || e.root.journal == nil {
+		return nil
+	}
+	changes := make([]change, 0, len(e.root.journal.changes))
+	for _, c := range e.root.journal.changes {
+		if !c.dryRun {
+			changes = append(changes, c)
+		}
+	}
+	return &InversePatch{changes: changes}
+}
+
+// Changes reports the changes made by the mutations of the MatchSet since
+// ReportChanges or DryRun was enabled, in the order they were made. In dry-run
+// mode, these are the changes the mutations would have made. Returns nil if
+// neither option is enabled.
+func (e *MatchSet) Changes() []Change {
+	if !e.options.ReportChanges && !e.options.DryRun || e.root.journal == nil {
+		return nil
+	}
+	result := make([]Change, 0, len(e.root.journal.changes))
+	for _, c := range e.root.journal.changes {
+		result = append(result, c.report())
+	}
+	return result
 }
 
 // Values returns an array of all the values selected by the jsonmatch
 func (e *MatchSet) Values() []interface{} {
-	if e.mutated {
-		panic("Values are not availible after extract has been mutated")
-	}
 	return e.ref.Values()
 }
 
-// Set updates all selected values to the provided value
+// Set updates all selected values to the provided value. Missing keys and arrays
+// on the path are created, as are items missing from `[_key == "x"]` filters, while
+// filters on any other field only ever select existing items.
 func (e *MatchSet) Set(value interface{}) (interface{}, error) {
-	if e.mutated {
-		return nil, errors.New("This extract has allready mutated once")
+	return e.apply(func() error {
+		if err := e.ref.Set(value); err != nil {
+			return err
+		}
+		return e.track(true, nil)
+	})
+}
+
+// CompareAndSet updates all selected values to newValue, but only if each of them
+// currently deep-equals expected. Paths that do not exist are considered to hold
+// nil. If any of the values differ, nothing is changed and a *ConflictError
+// listing their paths is returned.
+func (e *MatchSet) CompareAndSet(expected, newValue interface{}) (interface{}, error) {
+	var conflicts []string
+	for _, r := range individualRefs(e.ref) {
+		if latent, ok := r.(*LatentMapRef); ok {
+			if expected != nil {
+				conflicts = append(conflicts, latent.identities()...)
+			}
+			continue
+		}
+		for _, v := range r.Vars() {
+			if !valuesEqual(v.Value(), expected) {
+				conflicts = append(conflicts, v.id())
+			}
+		}
 	}
-	err := e.ref.Set(value)
-	if err != nil {
-		return nil, err
+	if len(conflicts) > 0 {
+		return nil, &ConflictError{Paths: conflicts}
 	}
-	e.mutated = true
-	return e.root.Value(), nil
+	return e.Set(newValue)
 }
 
-// Delete deletes all selected values from the underlying data
+// SetIfMissing updates the selected values to the provided value, but only where
+// there is no value yet or the value is nil. Existing values are left untouched,
+// while missing paths are created the same way Set creates them.
+func (e *MatchSet) SetIfMissing(value interface{}) (interface{}, error) {
+	return e.apply(func() error {
+		if err := setIfMissing(e.ref, value); err != nil {
+			return err
+		}
+		return e.track(true, nil)
+	})
+}
+
+// Delete deletes all selected values from the underlying data. Afterwards the
+// MatchSet still refers to the deleted map members, so Set creates them again,
+// while deleted array items and everything inside the deleted values are gone.
 func (e *MatchSet) Delete() (interface{}, error) {
-	if e.mutated {
-		return nil, errors.New("This extract has allready mutated once")
-	}
-	err := e.ref.Delete()
-	if err != nil {
-		return nil, err
-	}
-	e.mutated = true
-	return e.root.Value(), nil
+	return e.apply(func() error {
+		if err := e.ref.Delete(); err != nil {
+			return err
+		}
+		var kept []Ref
+		var deleted []*ArrayRef
+		for _, r := range individualRefs(e.ref) {
+			if arrayRef, ok := r.(*ArrayRef); ok {
+				// The positions of the deleted items hold other items now, if any
+				deleted = append(deleted, arrayRef)
+				continue
+			}
+			kept = append(kept, r)
+		}
+		e.ref = NewUnionRef(kept...)
+		return e.track(false, deleted)
+	})
 }
 
 // Mutate passes all selected values through the mutator and updates them
 // in the underlying value
 func (e *MatchSet) Mutate(mutator MutatorFunc) (interface{}, error) {
-	if e.mutated {
-		return nil, errors.New("This extract has allready mutated once")
+	var failed *MultiError
+	if e.options.ErrorPolicy != AbortOnError {
+		failed = &MultiError{}
+		mutator = collectErrors(mutator, failed)
 	}
-	err := e.ref.Mutate(mutator)
+	return e.apply(func() error {
+		if err := e.ref.Mutate(mutator); err != nil {
+			return err
+		}
+		if err := e.track(true, nil); err != nil {
+			return err
+		}
+		if failed != nil && len(failed.Errors) > 0 {
+			return failed
+		}
+		return nil
+	})
+}
+
+// collectErrors wraps the mutator so that failing values are left unchanged and
+// their errors are collected
+func collectErrors(mutator MutatorFunc, failed *MultiError) MutatorFunc {
+	return func(path string, value interface{}) (interface{}, error) {
+		newValue, err := mutator(path, value)
+		if err == nil {
+			err = assertIsCompatible(newValue)
+		}
+		if err != nil {
+			failed.Errors = append(failed.Errors, &PathError{Path: path, Err: err})
+			return nil, errUnchanged
+		}
+		return newValue, nil
+	}
+}
+
+// Inc adds the numeric amount n to all selected values. The values keep their
+// original Go type, so an int stays an int and a json.Number is updated using
+// exact decimal arithmetic. If any selected value is not numeric, an error naming
+// its path is returned. Missing values are not created as Set does, so a path that
+// does not exist, or holds null, fails the same way.
+func (e *MatchSet) Inc(n interface{}) (interface{}, error) {
+	mutator, err := incrementMutator(n, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.Mutate(mutator)
+}
+
+// Dec subtracts the numeric amount n from all selected values. See Inc.
+func (e *MatchSet) Dec(n interface{}) (interface{}, error) {
+	mutator, err := incrementMutator(n, true)
 	if err != nil {
 		return nil, err
 	}
-	e.mutated = true
-	return e.root.Value(), nil
+	return e.Mutate(mutator)
+}
+
+// RenameKey renames the keys of all selected map members to newName, keeping
+// their values. Selections must only contain map members, and at most one key
+// per map may be selected. Nothing is changed if any of the keys can not be
+// renamed.
+func (e *MatchSet) RenameKey(newName string) (interface{}, error) {
+	// Check that all renames are possible before touching anything
+	var mapRefs []*MapRef
+	for _, r := range individualRefs(e.ref) {
+		switch t := r.(type) {
+		case *MapRef:
+			if _, err := t.renamableKey(newName); err != nil {
+				return nil, err
+			}
+			mapRefs = append(mapRefs, t)
+		case *LatentMapRef:
+			// Refers to no values, so there is nothing to rename
+		default:
+			return nil, fmt.Errorf("Cannot rename keys of a %T ref. All selected values must be map members", r)
+		}
+	}
+
+	return e.apply(func() error {
+		for _, ref := range mapRefs {
+			if err := ref.Rename(newName); err != nil {
+				return err
+			}
+		}
+		return e.track(false, nil)
+	})
 }
 
 // MutateRegions mutates the elements of each selected array as single operations. The
@@ -74,10 +342,6 @@ func (e *MatchSet) Mutate(mutator MutatorFunc) (interface{}, error) {
 // replace etc. If the method is used on selections that also include non-array
 // members, an error is returned.
 func (e *MatchSet) MutateRegions(mutator MutateRegionsFunc) (interface{}, error) {
-	if e.mutated {
-		return nil, errors.New("This extract has allready mutated once")
-	}
-
 	// Extract all array references to be mutated
 	var arrayRefs []*ArrayRef
 	switch t := e.ref.(type) {
@@ -86,6 +350,10 @@ func (e *MatchSet) MutateRegions(mutator MutateRegionsFunc) (interface{}, error)
 	case *UnionRef:
 		arrayRefs = make([]*ArrayRef, 0, len(t.refs))
 		for _, r := range t.refs {
+			if _, isLatent := r.(*LatentMapRef); isLatent {
+				// Refers to no values, so there is nothing to mutate
+				continue
+			}
 			arrayRef, ok := r.(*ArrayRef)
 			if !ok {
 				return nil, fmt.Errorf("Cannot mutate regions of a %T ref. All selected values must be array members", r)
@@ -95,11 +363,134 @@ func (e *MatchSet) MutateRegions(mutator MutateRegionsFunc) (interface{}, error)
 	}
 
 	// Perform the mutations
-	for _, ref := range arrayRefs {
-		if err := ref.MutateRegions(mutator); err != nil {
+	return e.apply(func() error {
+		for _, ref := range arrayRefs {
+			if err := ref.MutateRegions(mutator); err != nil {
+				return err
+			}
+		}
+		return e.track(false, arrayRefs)
+	})
+}
+
+// apply performs a mutation of the MatchSet and returns the resulting document. In
+// dry-run mode, or when rolling back after errors, the document and the matches are
+// restored afterwards. A *MultiError from the mutation is returned along with the
+// document, unless the mutation was rolled back.
+func (e *MatchSet) apply(mutation func() error) (interface{}, error) {
+	revertible := e.options.DryRun || e.options.ErrorPolicy == RollbackOnError
+	e.root.beginMutation(e.options.InPlace && !revertible)
+	defer e.root.endMutation()
+	if e.root.observer != nil {
+		// Containers may be modified after they were rewritten, so the observer
+		// is notified once the mutation is complete
+		e.root.observer.hold()
+	}
+	if !revertible {
+		err := mutation()
+		if e.root.observer != nil {
+			e.root.observer.release(true)
+		}
+		if _, partial := err.(*MultiError); err != nil && !partial {
 			return nil, err
 		}
+		return e.result(e.root.Value()), err
+	}
+
+	original, ref := e.root.Value(), cloneRef(e.ref)
+	recorded := 0
+	if e.root.journal != nil {
+		recorded = len(e.root.journal.changes)
+		e.root.journal.dryRun = e.options.DryRun
+	}
+	err := mutation()
+	if e.root.journal != nil {
+		e.root.journal.dryRun = false
+	}
+	if err == nil && !e.options.DryRun {
+		if e.root.observer != nil {
+			e.root.observer.release(true)
+		}
+		return e.result(e.root.Value()), nil
+	}
+	if !e.options.DryRun && e.root.journal != nil {
+		// Rolled back changes were never made
+		e.root.journal.changes = e.root.journal.changes[:recorded]
+	}
+	e.ref = ref
+	restoreErr := e.root.write(original)
+	if e.root.observer != nil {
+		// Neither the reverted mutation nor the restore are observed
+		e.root.observer.release(false)
+	}
+	if restoreErr != nil {
+		return nil, restoreErr
+	}
+	if _, partial := err.(*MultiError); err != nil && !(partial && e.options.DryRun) {
+		return nil, err
+	}
+	return e.result(original), err
+}
+
+// result returns the document to be returned by a mutation, as set by the DeepCopy
+// option
+func (e *MatchSet) result(doc interface{}) interface{} {
+	if e.options.DeepCopy {
+		return deepCopy(doc)
+	}
+	return doc
+}
+
+// track updates the refs of the MatchSet after a mutation. If realized is true,
+// latent refs are replaced by refs to the values that were created for them. Refs
+// nested inside the selections of spliced arrays, and refs to containers that have
+// been replaced by something else are dropped.
+func (e *MatchSet) track(realized bool, spliced []*ArrayRef) error {
+	refs := individualRefs(e.ref)
+	tracked := make([]Ref, 0, len(refs))
+	for _, r := range refs {
+		if latent, ok := r.(*LatentMapRef); ok && realized {
+			resolved, err := latent.resolve()
+			if err != nil {
+				return err
+			}
+			tracked = append(tracked, individualRefs(resolved)...)
+			continue
+		}
+		if isStale(r, spliced) {
+			continue
+		}
+		tracked = append(tracked, r)
+	}
+	e.ref = NewUnionRef(tracked...)
+	return nil
+}
+
+// isStale is true if the ref no longer refers to the values it was matched against
+func isStale(ref Ref, spliced []*ArrayRef) bool {
+	var variable *VarRef
+	switch t := ref.(type) {
+	case *MapRef:
+		if !t.variable.IsMap() {
+			return true
+		}
+		variable = t.variable
+	case *ArrayRef:
+		if !t.variable.IsSlice() {
+			return true
+		}
+		if current, err := t.variable.canonicalSlice(); err != nil || len(t.selection) > 0 && t.selection[len(t.selection)-1].End > len(current) {
+			return true
+		}
+		variable = t.variable
+	default:
+		return false
+	}
+	for _, arrayRef := range spliced {
+		if strings.HasPrefix(variable.id(), arrayRef.variable.id()+"[") {
+			// Positions within the spliced array are no longer known
+			return true
+		}
 	}
-	e.mutated = true
-	return e.root.Value(), nil
+	return false
 }
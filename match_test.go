@@ -1,7 +1,13 @@
 package jsonmatch_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -124,6 +130,21 @@ func TestMatch_simpleArrayRangeExtraction(t *testing.T) {
 	ms, err = match("array[:3]", record)
 	assert.NoError(t, err)
 	assert.Equal(t, []interface{}{0, 10, 20}, ms.Values())
+
+	// Negative steps run backwards from the start, and select in document order
+	for src, values := range map[string][]interface{}{
+		"array[3:0:-1]":  {10, 20, 30},
+		"array[:1:-1]":   {20, 30, 40},
+		"array[-1:0:-2]": {20, 40},
+		"array[1:3:-1]":  {},
+		"array[9:-9:-3]": {10, 40},
+		"array[3:1]":     {},
+		"array[9:]":      {},
+	} {
+		ms, err = match(src, record)
+		assert.NoError(t, err)
+		assert.Equal(t, values, ms.Values(), src)
+	}
 }
 
 func TestMatch_wildcard(t *testing.T) {
@@ -150,6 +171,54 @@ func TestMatch_recursiveAssignment(t *testing.T) {
 	assert.Equal(t, []interface{}{"Ghost", "Ghost", "Ghost", "Ghost", "Ghost"}, ms2.Values())
 }
 
+func TestMatch_recursiveDepthBounds(t *testing.T) {
+	for src, expected := range map[string][]interface{}{
+		"..{0,0}name": {"root"},
+		"..{,1}name":  {"root"},
+		"..{2}name":   {"Blinky", "Pinky", "Inky", "Clyde"},
+		"..{2,}name":  {"Blinky", "Pinky", "Inky", "Clyde"},
+		"..{1,5}name": {"Blinky", "Pinky", "Inky", "Clyde"},
+		"..{3,}name":  {},
+	} {
+		ms, err := match(src, testRecord())
+		require.NoError(t, err, src)
+		assert.Equal(t, expected, ms.Values(), src)
+	}
+	ms, err := match("..{1}", testRecord())
+	require.NoError(t, err)
+	assert.Len(t, ms.Values(), 6)
+
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}},
+		"d": []interface{}{2},
+	}
+	for src, expected := range map[string][]interface{}{
+		"..{2}":  {doc["a"].(map[string]interface{})["b"], 2},
+		"..{,1}": {doc, doc["a"], doc["d"]},
+		"..{3,}": {1},
+	} {
+		ms, err := match(src, doc)
+		require.NoError(t, err, src)
+		values := ms.Values()
+		assert.Len(t, values, len(expected), src)
+		for _, value := range expected {
+			assert.Contains(t, values, value, src)
+		}
+	}
+
+	_, err = jsonmatch.Parse("a..{3,1}b")
+	parseErr, ok := err.(*jsonmatch.ParseError)
+	if assert.True(t, ok, "A minimum depth above the maximum must not parse") {
+		assert.Equal(t, "The maximum depth must not be less than the minimum depth", parseErr.Message)
+	}
+
+	for _, src := range []string{"..{3,1}", "..{a}", "..{1", "..{-1}", "..{}"} {
+		_, err := jsonmatch.Parse(src)
+		_, isParseError := err.(*jsonmatch.ParseError)
+		assert.True(t, isParseError, "%s must not parse", src)
+	}
+}
+
 func TestMatch_union(t *testing.T) {
 	ms, err := match("ghosts..['name', 'color']", testRecord())
 	assert.NoError(t, err)
@@ -247,3 +316,1694 @@ func TestMatch_TrailingNakedInteger(t *testing.T) {
 	_, err = match("milestones[0]", 0)
 	assert.NoError(t, err)
 }
+
+func TestMatch_IncPreservesTypes(t *testing.T) {
+	doc := map[string]interface{}{
+		"int":    41,
+		"int64":  int64(9007199254740993),
+		"float":  1.5,
+		"number": json.Number("0.1"),
+		"uint8":  uint8(7),
+	}
+	ms, err := match("[int,int64,float,number,uint8]", doc)
+	require.NoError(t, err)
+	mutated, err := ms.Inc(1)
+	require.NoError(t, err)
+	result := mutated.(map[string]interface{})
+	assert.Equal(t, 42, result["int"])
+	assert.Equal(t, int64(9007199254740994), result["int64"])
+	assert.Equal(t, 2.5, result["float"])
+	assert.Equal(t, json.Number("1.1"), result["number"])
+	assert.Equal(t, uint8(8), result["uint8"])
+	assert.Equal(t, 41, doc["int"], "Incrementing should not mutate the underlying data")
+
+	ms, err = match("number", doc)
+	require.NoError(t, err)
+	mutated, err = ms.Inc(json.Number("0.2"))
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("0.3"), mutated.(map[string]interface{})["number"],
+		"json.Number should use exact decimal arithmetic")
+}
+
+func TestMatch_Dec(t *testing.T) {
+	ms, err := match("array[1:3]", testRecord())
+	require.NoError(t, err)
+	mutated, err := ms.Dec(5)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 5, 15, 30, 40}, mutated.(map[string]interface{})["array"])
+
+	ms, err = match("products[0].newPrice", testRecord())
+	require.NoError(t, err)
+	mutated, err = ms.Dec(0.4)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{12.0}, extractValues(t, "products[0].newPrice", mutated))
+}
+
+func TestMatch_IncRejectsNonNumeric(t *testing.T) {
+	ms, err := match("ghosts[0].name", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Inc(1)
+	assert.EqualError(t, err, "Cannot increment non-numeric value Blinky at $.ghosts[000000].name")
+
+	ms, err = match("array[0]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Inc(0.5)
+	assert.EqualError(t, err, "Cannot add fractional amount 1/2 to integer value 0 at $.array[000000]")
+
+	ms, err = match("missing.count", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Dec(1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Cannot increment missing value at $.")
+	}
+
+	ms, err = match("count", map[string]interface{}{"count": int8(127)})
+	require.NoError(t, err)
+	_, err = ms.Inc(1)
+	assert.EqualError(t, err, "Adding 1 to 127 overflows int8 at $.count")
+
+	ms, err = match("array[0]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Inc("one")
+	assert.EqualError(t, err, "Increment amount must be numeric, got string")
+}
+
+func TestMatch_SetIfMissing(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{
+			"present": "keep me",
+			"null":    nil,
+			"string":  "not a map",
+		},
+		"array": []interface{}{1, nil, 3},
+	}
+	ms, err := match("a[present,null,absent]", doc)
+	require.NoError(t, err)
+	mutated, err := ms.SetIfMissing("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"present": "keep me",
+		"null":    "default",
+		"string":  "not a map",
+		"absent":  "default",
+	}, mutated.(map[string]interface{})["a"])
+
+	ms, err = match("array[*]", doc)
+	require.NoError(t, err)
+	mutated, err = ms.SetIfMissing(2)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{1, 2, 3}, mutated.(map[string]interface{})["array"])
+
+	// Latent paths are realized, but never through existing non-map values
+	ms, err = match("a[string,deep].nested.value", doc)
+	require.NoError(t, err)
+	mutated, err = ms.SetIfMissing(true)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"not a map"}, extractValues(t, "a.string", mutated))
+	assert.Equal(t, []interface{}{true}, extractValues(t, "a.deep.nested.value", mutated))
+	assert.Nil(t, doc["a"].(map[string]interface{})["deep"], "Should not mutate the underlying data")
+}
+
+func TestApplyDefaults(t *testing.T) {
+	doc := map[string]interface{}{
+		"title": "Hello",
+		"meta":  map[string]interface{}{"tags": []interface{}{"news"}},
+	}
+	result, err := jsonmatch.ApplyDefaults(doc, map[string]interface{}{
+		"title":          "Untitled",
+		"meta.tags":      []interface{}{},
+		"meta.author":    "anonymous",
+		"stats.views":    0,
+		"stats.comments": 0,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"title": "Hello",
+		"meta": map[string]interface{}{
+			"tags":   []interface{}{"news"},
+			"author": "anonymous",
+		},
+		"stats": map[string]interface{}{"views": 0, "comments": 0},
+	}, result)
+
+	_, err = jsonmatch.ApplyDefaults(doc, map[string]interface{}{"a[": 1})
+	assert.Error(t, err)
+}
+
+func TestMatch_LatentArrays(t *testing.T) {
+	ms, err := match("a.items[0].title", map[string]interface{}{"a": map[string]interface{}{}})
+	require.NoError(t, err)
+	modified, err := ms.Set("first")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{
+			"items": []interface{}{map[string]interface{}{"title": "first"}},
+		},
+	}, modified)
+
+	// Existing empty arrays get an item inserted
+	ms, err = match("items[-1].title", map[string]interface{}{"items": []interface{}{}})
+	require.NoError(t, err)
+	modified, err = ms.Set("last")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"last"}, extractValues(t, "items[0].title", modified))
+
+	// Indicies beyond the start or end of a missing array can not be created
+	ms, err = match("items[3].title", map[string]interface{}{})
+	require.NoError(t, err)
+	modified, err = ms.Set("nope")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{}, modified)
+
+	// Mutate only changes existing items, and never inserts any
+	ms, err = match("items[0]", map[string]interface{}{"items": []interface{}{}})
+	require.NoError(t, err)
+	modified, err = ms.Mutate(func(path string, value interface{}) (interface{}, error) {
+		t.Errorf("Mutated missing item %s", path)
+		return value, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"items": []interface{}{}}, modified)
+
+	// Existing arrays are never replaced
+	ms, err = match("array[0].title", testRecord())
+	require.NoError(t, err)
+	modified, err = ms.Set("nope")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]interface{}{0, 10, 20, 30, 40}}, extractValues(t, "array", modified))
+}
+
+func TestMatch_UpsertKeyedItems(t *testing.T) {
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"_key": "a", "title": "A"},
+		},
+	}
+	ms, err := match(`items[_key=="b"].title`, doc)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, ms.Values())
+	modified, err := ms.Set("B")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"_key": "a", "title": "A"},
+		map[string]interface{}{"_key": "b", "title": "B"},
+	}, modified.(map[string]interface{})["items"])
+	assert.Equal(t, 1, len(doc["items"].([]interface{})), "Should not mutate the underlying data")
+
+	// Matching items are updated rather than inserted
+	ms, err = match(`items[_key=="a"].title`, modified)
+	require.NoError(t, err)
+	modified, err = ms.Set("AA")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"AA", "B"}, extractValues(t, "items[*].title", modified))
+
+	// Missing arrays are created
+	ms, err = match(`meta.items[_key=="x"].title`, map[string]interface{}{})
+	require.NoError(t, err)
+	modified, err = ms.Set("X")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"meta": map[string]interface{}{
+			"items": []interface{}{map[string]interface{}{"_key": "x", "title": "X"}},
+		},
+	}, modified)
+
+	// Setting the item itself adds the key to it
+	ms, err = match(`items[_key=="c"]`, doc)
+	require.NoError(t, err)
+	modified, err = ms.Set(map[string]interface{}{"title": "C"})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"c"}, extractValues(t, `items[title=="C"]._key`, modified))
+
+	// Only maps can be keyed items, anything else could never be matched again
+	ms, err = match(`items[_key=="zz"]`, doc)
+	require.NoError(t, err)
+	_, err = ms.Set("X")
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(doc["items"].([]interface{})))
+
+	// The key identifying a new item can not be set to anything else
+	ms, err = match(`items[_key=="c"]._key`, doc)
+	require.NoError(t, err)
+	_, err = ms.Set("d")
+	assert.EqualError(t, err, `Cannot set _key of the item with _key == "c", it is the key identifying the item`)
+	ms, err = match(`items[_key=="c"]`, doc)
+	require.NoError(t, err)
+	_, err = ms.Set(map[string]interface{}{"_key": "d"})
+	assert.EqualError(t, err, `Cannot insert the item with _key == "c", it has _key == d`)
+
+	// Filters on anything but the key select items, and never create them
+	for _, src := range []string{`items[title=="B"].title`, `items[n==5].flag`, `items[_key==5].flag`, `items[title=="B"]`} {
+		ms, err = match(src, doc)
+		require.NoError(t, err)
+		modified, err = ms.Set("X")
+		require.NoError(t, err, src)
+		assert.Equal(t, doc, modified, src)
+	}
+}
+
+func TestMatch_NoUpsertThroughRecursion(t *testing.T) {
+	ms, err := match(`..[_key=="nope"].title`, testRecord())
+	require.NoError(t, err)
+	modified, err := ms.Set("Nope")
+	require.NoError(t, err)
+	assert.Equal(t, testRecord(), modified)
+}
+
+func TestCopyAndMove(t *testing.T) {
+	record := testRecord()
+	copied, err := jsonmatch.Copy(record, "some.path", "copies.path")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"hello there"}, extractValues(t, "some.path", copied))
+	assert.Equal(t, []interface{}{"hello there"}, extractValues(t, "copies.path", copied))
+	assert.Nil(t, record["copies"], "Should not mutate the underlying data")
+
+	copied, err = jsonmatch.Copy(record, "some", "copies")
+	require.NoError(t, err)
+	copied.(map[string]interface{})["copies"].(map[string]interface{})["path"] = "changed"
+	assert.Equal(t, []interface{}{"hello there"}, extractValues(t, "some.path", copied),
+		"The copy should not share its maps with the source")
+
+	moved, err := jsonmatch.Move(record, "ghosts[0]", "ghosts[-1]")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"Pinky", "Inky", "Blinky"}, extractValues(t, "ghosts[*].name", moved),
+		"Target is resolved after removing the source")
+
+	moved, err = jsonmatch.Move(record, "some.path", "greeting")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"hello there"}, extractValues(t, "greeting", moved))
+	assert.Equal(t, []interface{}{}, extractValues(t, "some.path", moved))
+}
+
+func TestCopyAndMove_Atomic(t *testing.T) {
+	record := testRecord()
+	result, err := jsonmatch.Move(record, "array[*]", "other")
+	assert.EqualError(t, err, "\"array[*]\" must match exactly one value, matched 5")
+	assert.Equal(t, record, result)
+
+	result, err = jsonmatch.Move(record, "some.path", "array[9]")
+	assert.EqualError(t, err, "\"array[9]\" does not match any location that can be set")
+	assert.Equal(t, testRecord(), result, "Source must be left in place when the target fails")
+
+	result, err = jsonmatch.Copy(record, "nothing.here", "other")
+	assert.Error(t, err)
+	assert.Equal(t, record, result)
+}
+
+func TestMatch_RenameKey(t *testing.T) {
+	doc := map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{"_type": "image", "asset": "a1"},
+			map[string]interface{}{"_type": "block", "asset": "b1"},
+			map[string]interface{}{"_type": "gallery", "images": []interface{}{
+				map[string]interface{}{"_type": "image", "asset": "a2"},
+				map[string]interface{}{"_type": "image"},
+			}},
+		},
+	}
+	ms, err := match(`..[_type=="image"].asset`, doc)
+	require.NoError(t, err)
+	renamed, err := ms.RenameKey("image")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"a2", "a1"}, extractValues(t, "..image", renamed))
+	assert.Equal(t, []interface{}{"b1"}, extractValues(t, "..asset", renamed))
+
+	ms, err = match("some[path,wrongPath]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.RenameKey("other")
+	assert.EqualError(t, err, "Cannot rename both $.some.path and $.some.wrongPath to \"other\"")
+
+	ms, err = match("some.path", testRecord())
+	require.NoError(t, err)
+	_, err = ms.RenameKey("wrongPath")
+	assert.EqualError(t, err, "Cannot rename $.some.path to \"wrongPath\", the key allready exists")
+
+	ms, err = match("array[0]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.RenameKey("first")
+	assert.EqualError(t, err, "Cannot rename keys of a *jsonmatch.ArrayRef ref. All selected values must be map members")
+}
+
+func TestMatch_SequentialMutations(t *testing.T) {
+	ms, err := match("products[*].newPrice", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Set(10)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 10}, ms.Values())
+	_, err = ms.Inc(5)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{15, 15}, ms.Values())
+	result, err := ms.Mutate(func(path string, value interface{}) (interface{}, error) {
+		return value.(int) * 2, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{30, 30}, ms.Values())
+	assert.Equal(t, []interface{}{30, 30}, extractValues(t, "products[*].newPrice", result))
+
+	// Filters are not re-evaluated, so the matches are kept even when they no
+	// longer satisfy the filter
+	ms, err = match(`ghosts[name=="Clyde"].name`, testRecord())
+	require.NoError(t, err)
+	_, err = ms.Set("Sue")
+	require.NoError(t, err)
+	result, err = ms.Set("Clyde again")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"Clyde again"}, ms.Values())
+	assert.Equal(t, []interface{}{"Blinky", "Pinky", "Inky", "Clyde again"}, extractValues(t, "ghosts[*].name", result))
+
+	ms, err = match("array[1:3]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Delete()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, ms.Values())
+	result, err = ms.Set("ignored")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 30, 40}, result.(map[string]interface{})["array"])
+
+	// Deleted map members are created again, and values inside deleted values are gone
+	ms, err = match("[some, some.path, array[1]]", testRecord())
+	require.NoError(t, err)
+	result, err = ms.Delete()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, ms.Values())
+	assert.Equal(t, []interface{}{}, extractValues(t, "some", result))
+	result, err = ms.Set("again")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"again"}, ms.Values())
+	assert.Equal(t, []interface{}{"again"}, extractValues(t, "some", result))
+	assert.Equal(t, []interface{}{0, 20, 30, 40}, result.(map[string]interface{})["array"])
+}
+
+func TestMatch_SequentialMutationsOfLatentPaths(t *testing.T) {
+	ms, err := match(`a.items[_key=="x"].count`, map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, ms.Values())
+	_, err = ms.Set(1)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{1}, ms.Values())
+	result, err := ms.Inc(1)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{2}, ms.Values())
+	assert.Equal(t, 1, len(extractValues(t, "a.items[*]", result).([]interface{})),
+		"The item must only be created once")
+}
+
+func TestMatch_SequentialMutateRegions(t *testing.T) {
+	ms, err := match("array[1:3]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.MutateRegions(func(path string, current [][]interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{"a", "b", "c"}}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, ms.Values())
+	result, err := ms.Set("x")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, "x", "x", "x", 30, 40}, result.(map[string]interface{})["array"])
+
+	// Values nested inside replaced containers are dropped
+	ms, err = match("[some, some.path]", testRecord())
+	require.NoError(t, err)
+	_, err = ms.Set("flat")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"flat"}, ms.Values())
+}
+
+func TestMatch_IncompatibleNestedTypes(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{
+			"intKeys": map[int]interface{}{1: "one"},
+			"array":   [3]int{1, 2, 3},
+			"ok":      map[string]interface{}{"c": 1},
+		},
+	}
+	for _, path := range []string{
+		"a.intKeys.c",
+		"a.intKeys[?(@ == 1)]",
+		"a.*.c",
+		"a..c",
+		"a.array[0]",
+		"a.array[1:]",
+		"a.array[?(@ == 1)]",
+	} {
+		_, err := match(path, doc)
+		assert.Error(t, err, path)
+	}
+
+	ms, err := match("a.ok.c", doc)
+	require.NoError(t, err)
+	_, err = ms.Set(map[int]interface{}{1: "one"})
+	assert.Error(t, err)
+	_, err = ms.Mutate(func(_ string, _ interface{}) (interface{}, error) {
+		return map[int]interface{}{1: "one"}, nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, doc["a"].(map[string]interface{})["ok"].(map[string]interface{})["c"])
+}
+
+func TestTransaction(t *testing.T) {
+	record := testRecord()
+	result, err := jsonmatch.Transaction(record).
+		Set("some.path", "updated").
+		Delete("ghosts[?(@.name == \"Inky\")]").
+		MutateRegions("array[-1]", func(_ string, current [][]interface{}) ([][]interface{}, error) {
+			return [][]interface{}{append(current[0], 50)}, nil
+		}).
+		Set("ghosts[-1].color", "yellow").
+		Commit()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"updated"}, extractValues(t, "some.path", result))
+	assert.Equal(t, []interface{}{"Blinky", "Pinky", "Clyde"}, extractValues(t, "ghosts[*].name", result))
+	assert.Equal(t, []interface{}{"yellow"}, extractValues(t, "ghosts[-1].color", result))
+	assert.Equal(t, []interface{}{0, 10, 20, 30, 40, 50}, extractValues(t, "array", result).([]interface{})[0])
+	assert.Equal(t, testRecord(), record, "The original document must not be modified")
+}
+
+func TestTransaction_Rollback(t *testing.T) {
+	record := testRecord()
+	tx := jsonmatch.Transaction(record).
+		Set("some.path", "updated").
+		Delete("array[0]").
+		Inc("name", 1)
+	result, err := tx.Commit()
+	require.Error(t, err)
+	assert.Equal(t, record, result, "The original document must be returned")
+	assert.Equal(t, testRecord(), record)
+
+	txErr, ok := err.(*jsonmatch.TransactionError)
+	require.True(t, ok, "Error must be a *TransactionError")
+	assert.Equal(t, 2, txErr.Step)
+	assert.Equal(t, "name", txErr.Path)
+	assert.EqualError(t, err, "Transaction step 2 (\"name\") failed: Cannot increment non-numeric value root at $.name")
+
+	_, err = jsonmatch.Transaction(record).Set("some[", 1).Commit()
+	txErr, ok = err.(*jsonmatch.TransactionError)
+	require.True(t, ok, "Parse errors must be reported as a *TransactionError")
+	assert.Equal(t, 0, txErr.Step)
+}
+
+func TestMatch_CompareAndSet(t *testing.T) {
+	record := testRecord()
+	ms, err := match("array[1:3]", record)
+	require.NoError(t, err)
+	_, err = ms.CompareAndSet(10, 100)
+	assert.EqualError(t, err, "Conflicting values at $.array[000002]")
+	conflict, ok := err.(*jsonmatch.ConflictError)
+	require.True(t, ok, "Error must be a *ConflictError")
+	assert.Equal(t, []string{"$.array[000002]"}, conflict.Paths)
+	assert.Equal(t, testRecord(), record)
+
+	ms, err = match("some.path", record)
+	require.NoError(t, err)
+	result, err := ms.CompareAndSet("hello there", "updated")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"updated"}, extractValues(t, "some.path", result))
+
+	// Numbers compare by value and containers compare deeply
+	doc := map[string]interface{}{
+		"rev":  json.Number("3"),
+		"tags": []string{"a", "b"},
+	}
+	ms, err = match("[rev, tags]", doc)
+	require.NoError(t, err)
+	_, err = ms.CompareAndSet(3, "x")
+	assert.EqualError(t, err, "Conflicting values at $.tags")
+	ms, err = match("tags", doc)
+	require.NoError(t, err)
+	_, err = ms.CompareAndSet([]interface{}{"a", "b"}, []interface{}{"c"})
+	assert.NoError(t, err)
+
+	// Missing values are nil
+	ms, err = match("meta.rev", doc)
+	require.NoError(t, err)
+	_, err = ms.CompareAndSet(1, 2)
+	assert.EqualError(t, err, "Conflicting values at $.meta.rev")
+	result, err = ms.CompareAndSet(nil, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{1}, extractValues(t, "meta.rev", result))
+}
+
+func TestTransaction_If(t *testing.T) {
+	doc := map[string]interface{}{
+		"rev":   3,
+		"title": "Hello",
+		"tags":  []interface{}{"draft"},
+	}
+	result, err := jsonmatch.Transaction(doc).
+		Set("title", "Updated").If("[rev == 3]").
+		Inc("rev", 1).If("[title == \"Updated\"]").
+		Delete("tags[0]").If("tags[@ == \"draft\"]").
+		Commit()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"rev": 4, "title": "Updated", "tags": []interface{}{}}, result)
+
+	result, err = jsonmatch.Transaction(doc).
+		Set("title", "Updated").If("[rev == 2]").
+		Commit()
+	assert.EqualError(t, err, "Transaction step 0 (\"title\") failed: Conflicting values at $.rev")
+	txErr, ok := err.(*jsonmatch.TransactionError)
+	require.True(t, ok, "Error must be a *TransactionError")
+	_, ok = txErr.Err.(*jsonmatch.ConflictError)
+	assert.True(t, ok, "Failed guards must be reported as a *ConflictError")
+	assert.Equal(t, doc, result)
+
+	_, err = jsonmatch.Transaction(doc).
+		CompareAndSet("rev", 2, 3).
+		Commit()
+	assert.EqualError(t, err, "Transaction step 0 (\"rev\") failed: Conflicting values at $.rev")
+
+	_, err = jsonmatch.Transaction(doc).
+		Set("title", "Updated").If("[rev == 2, title == @.tags[0]]").
+		Commit()
+	assert.EqualError(t, err, "Transaction step 0 (\"title\") failed: Conflicting values at $.rev, $.title, $.tags[000000]")
+	_, err = jsonmatch.Transaction(doc).
+		Delete("tags[0]").If("tags[@ == \"published\"]").
+		Commit()
+	assert.EqualError(t, err, "Transaction step 0 (\"tags[0]\") failed: Conflicting values at tags[@ == \"published\"]")
+
+	assert.Panics(t, func() { jsonmatch.Transaction(doc).If("[rev == 3]") }, "If must follow a step")
+}
+
+func TestMatch_Inverse(t *testing.T) {
+	appendItem := func(_ string, current [][]interface{}) ([][]interface{}, error) {
+		result := make([][]interface{}, len(current))
+		for i := range current {
+			result[i] = append(current[i], "new")
+		}
+		return result, nil
+	}
+	for _, c := range []struct {
+		path   string
+		mutate func(ms *jsonmatch.MatchSet) (interface{}, error)
+	}{
+		{"some.path", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Set("x") }},
+		{"some.new.deep[0].path", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Set("x") }},
+		{"ghosts[_key == \"sue\"].color", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Set("x") }},
+		{"array[1,3:]", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Delete() }},
+		{"[ghosts[0,2], ghosts[*].name]", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Delete() }},
+		{"some[path, wrongPath, missing]", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Delete() }},
+		{"array[*]", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Inc(1) }},
+		{"[array[0:2], otherArray[1:]]", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.MutateRegions(appendItem) }},
+		{"ghosts[*].name", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.RenameKey("title") }},
+		{"..color", func(ms *jsonmatch.MatchSet) (interface{}, error) { return ms.Set(nil) }},
+	} {
+		ms, err := match(c.path, testRecord())
+		require.NoError(t, err)
+		result, err := c.mutate(ms.WithOptions(jsonmatch.MutationOptions{RecordInverse: true}))
+		require.NoError(t, err, c.path)
+		require.NotEqual(t, testRecord(), result, c.path)
+		restored, err := ms.Inverse().Apply(result)
+		require.NoError(t, err, c.path)
+		assert.Equal(t, testRecord(), restored, c.path)
+	}
+}
+
+func TestMatch_InverseOfSequentialMutations(t *testing.T) {
+	type tags []interface{}
+	doc := map[string]interface{}{
+		"tags":  tags{"a", "b", "c"},
+		"count": json.Number("1.5"),
+	}
+	ms, err := match("[tags[1], count]", doc)
+	require.NoError(t, err)
+	assert.Nil(t, ms.Inverse(), "Nothing is recorded by default")
+	ms.WithOptions(jsonmatch.MutationOptions{RecordInverse: true})
+	_, err = ms.Set(2)
+	require.NoError(t, err)
+	_, err = ms.Inc(1)
+	require.NoError(t, err)
+	result, err := ms.Delete()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"tags": tags{"a", "c"}}, result)
+
+	restored, err := ms.Inverse().Apply(result)
+	require.NoError(t, err)
+	assert.Equal(t, doc, restored)
+	assert.Equal(t, map[string]interface{}{"tags": tags{"a", "c"}}, result, "The patched document must not be modified")
+}
+
+func TestMatch_ChangeReport(t *testing.T) {
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"_type": "price", "amount": 10},
+			map[string]interface{}{"_type": "note", "text": "hi"},
+			map[string]interface{}{"_type": "price", "amount": 20},
+		},
+		"the total": map[string]interface{}{"_type": "price", "amount": 30},
+	}
+	ms, err := match("..[_type==\"price\"].amount", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{DryRun: true})
+	result, err := ms.Inc(1)
+	require.NoError(t, err)
+	assert.Equal(t, doc, result, "Dry runs must return the document unchanged")
+	assert.Equal(t, []interface{}{10, 20, 30}, ms.Values(), "Dry runs must leave the matches alone")
+	assert.Equal(t, []jsonmatch.Change{
+		{Path: "items[0].amount", Op: jsonmatch.OpSet, Before: 10, After: 11},
+		{Path: "items[2].amount", Op: jsonmatch.OpSet, Before: 20, After: 21},
+		{Path: "['the total'].amount", Op: jsonmatch.OpSet, Before: 30, After: 31},
+	}, ms.Changes())
+
+	ms, err = match("[items[1].text, items[0].currency]", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{ReportChanges: true})
+	_, err = ms.Set("x")
+	require.NoError(t, err)
+	result, err = ms.Delete()
+	require.NoError(t, err)
+	assert.Equal(t, []jsonmatch.Change{
+		{Path: "items[0].currency", Op: jsonmatch.OpSet, Before: nil, After: "x"},
+		{Path: "items[1].text", Op: jsonmatch.OpSet, Before: "hi", After: "x"},
+		{Path: "items[0].currency", Op: jsonmatch.OpDelete, Before: "x"},
+		{Path: "items[1].text", Op: jsonmatch.OpDelete, Before: "x"},
+	}, ms.Changes())
+	assert.Equal(t, []interface{}{}, extractValues(t, "items[*].text", result))
+}
+
+func TestMatch_ChangeReportOfRegions(t *testing.T) {
+	ms, err := match("array[1:3]", testRecord())
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{ReportChanges: true})
+	result, err := ms.MutateRegions(func(_ string, current [][]interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{"a", "b", "c"}}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, "a", "b", "c", 30, 40}, result.(map[string]interface{})["array"])
+	assert.Equal(t, []jsonmatch.Change{{
+		Path:     "array",
+		Op:       jsonmatch.OpSplice,
+		Before:   [][]interface{}{{10, 20}},
+		After:    [][]interface{}{{"a", "b", "c"}},
+		Removed:  jsonmatch.Regions{{Start: 1, End: 3}},
+		Inserted: jsonmatch.Regions{{Start: 1, End: 4}},
+	}}, ms.Changes())
+
+	ms, err = match("array[0,2]", testRecord())
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{DryRun: true})
+	_, err = ms.Delete()
+	require.NoError(t, err)
+	changes := ms.Changes()
+	require.Equal(t, 1, len(changes))
+	assert.Equal(t, jsonmatch.Regions{{Start: 0, End: 1}, {Start: 2, End: 3}}, changes[0].Removed)
+	assert.Equal(t, jsonmatch.Regions{}, changes[0].Inserted)
+	assert.Equal(t, [][]interface{}{{0}, {20}}, changes[0].Before)
+}
+
+func TestMatch_DryRunOfLatentPaths(t *testing.T) {
+	doc := map[string]interface{}{
+		"list": []interface{}{},
+		"arr": []interface{}{
+			map[string]interface{}{"_key": "k1", "v": 1},
+			map[string]interface{}{"_key": "k2", "v": 2},
+		},
+	}
+	for _, src := range []string{"list[0]", "arr[_key==\"k9\"].v"} {
+		ms, err := match(src, doc)
+		require.NoError(t, err)
+		ms.WithOptions(jsonmatch.MutationOptions{DryRun: true})
+		result, err := ms.Set(3)
+		require.NoError(t, err)
+		assert.Equal(t, doc, result, src)
+		ms.WithOptions(jsonmatch.MutationOptions{})
+		result, err = ms.Set(3)
+		require.NoError(t, err, src)
+		assert.Equal(t, []interface{}{3}, extractValues(t, src, result), src)
+	}
+
+	ms, err := match("[list[0], arr[_key==\"k9\"]]", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{ErrorPolicy: jsonmatch.RollbackOnError})
+	_, err = ms.Set(3)
+	assert.Error(t, err, "Keyed items must be maps")
+	ms.WithOptions(jsonmatch.MutationOptions{})
+	result, err := ms.Set(map[string]interface{}{"v": 3})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{3}, extractValues(t, "arr[_key==\"k9\"].v", result))
+	assert.Equal(t, []interface{}{3}, extractValues(t, "list[0].v", result))
+}
+
+func TestMatch_MutateErrorPolicies(t *testing.T) {
+	doc := map[string]interface{}{
+		"values": []interface{}{1, "two", 3, "four"},
+	}
+	double := func(path string, value interface{}) (interface{}, error) {
+		n, ok := value.(int)
+		if !ok {
+			return nil, fmt.Errorf("not a number: %v", value)
+		}
+		return n * 2, nil
+	}
+
+	ms, err := match("values[*]", doc)
+	require.NoError(t, err)
+	_, err = ms.Mutate(double)
+	assert.EqualError(t, err, "not a number: two", "Mutations abort at the first error by default")
+
+	ms, err = match("values[*]", doc)
+	require.NoError(t, err)
+	result, err := ms.WithOptions(jsonmatch.MutationOptions{ErrorPolicy: jsonmatch.ApplyValid}).Mutate(double)
+	multiErr, ok := err.(*jsonmatch.MultiError)
+	require.True(t, ok, "Errors must be collected in a *MultiError")
+	assert.EqualError(t, err, "2 paths failed: $.values[000001]: not a number: two; $.values[000003]: not a number: four")
+	require.Equal(t, 2, len(multiErr.Errors))
+	assert.Equal(t, "$.values[000001]", multiErr.Errors[0].Path)
+	assert.Equal(t, map[string]interface{}{"values": []interface{}{2, "two", 6, "four"}}, result)
+	assert.Equal(t, []interface{}{2, "two", 6, "four"}, ms.Values())
+
+	ms, err = match("values[*]", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{ErrorPolicy: jsonmatch.RollbackOnError, ReportChanges: true})
+	result, err = ms.Mutate(double)
+	_, ok = err.(*jsonmatch.MultiError)
+	require.True(t, ok, "Errors must be collected in a *MultiError")
+	assert.Nil(t, result)
+	assert.Equal(t, []interface{}{1, "two", 3, "four"}, ms.Values(), "Nothing must change when rolling back")
+	assert.Equal(t, []jsonmatch.Change{}, ms.Changes())
+
+	ms, err = match("values[0,2]", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{ErrorPolicy: jsonmatch.RollbackOnError})
+	result, err = ms.Mutate(double)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"values": []interface{}{2, "two", 6, "four"}}, result)
+}
+
+func TestMatch_Observer(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{
+				map[string]interface{}{"c": 1},
+				map[string]interface{}{"c": 2},
+			},
+		},
+	}
+	var paths []string
+	observer := func(path string, oldValue, newValue interface{}) {
+		paths = append(paths, path)
+		assert.NotEqual(t, oldValue, newValue, "Rewritten containers at %s must differ", path)
+	}
+
+	expr, err := jsonmatch.Parse("a.b[1].c")
+	require.NoError(t, err)
+	ms, err := expr.MatchWithOptions(doc, jsonmatch.MutationOptions{Observer: observer})
+	require.NoError(t, err)
+	_, err = ms.Set(3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$", "a", "a.b", "a.b[1]"}, paths)
+
+	paths = nil
+	ms, err = match("a.b[*].c", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{Observer: observer, DryRun: true})
+	_, err = ms.Set(3)
+	require.NoError(t, err)
+	assert.Empty(t, paths, "Dry runs must not be observed")
+
+	ms.WithOptions(jsonmatch.MutationOptions{Observer: observer, ErrorPolicy: jsonmatch.RollbackOnError})
+	_, err = ms.Mutate(func(path string, value interface{}) (interface{}, error) {
+		if value == 2 {
+			return nil, fmt.Errorf("refusing %v", value)
+		}
+		return 10, nil
+	})
+	require.Error(t, err)
+	assert.Empty(t, paths, "Rolled back mutations must not be observed")
+}
+
+func TestMatch_CopyOnWrite(t *testing.T) {
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"n": 1},
+			map[string]interface{}{"n": 2},
+		},
+		"untouched": map[string]interface{}{"n": 3},
+	}
+	ms, err := match("items[*].n", doc)
+	require.NoError(t, err)
+	var paths []string
+	ms.WithOptions(jsonmatch.MutationOptions{Observer: func(path string, _, _ interface{}) {
+		paths = append(paths, path)
+	}})
+	result, err := ms.Set(10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$", "items", "items[0]", "items[1]"}, paths, "Each container must be copied once")
+	assert.Equal(t, 1, doc["items"].([]interface{})[0].(map[string]interface{})["n"], "The input must not be modified")
+	resultMap := result.(map[string]interface{})
+	assert.Equal(t, 10, resultMap["items"].([]interface{})[1].(map[string]interface{})["n"])
+	resultMap["untouched"].(map[string]interface{})["n"] = 4
+	assert.Equal(t, 4, doc["untouched"].(map[string]interface{})["n"], "Untouched containers must be shared")
+
+	_, err = ms.Set(20)
+	require.NoError(t, err)
+	assert.Equal(t, 10, resultMap["items"].([]interface{})[1].(map[string]interface{})["n"], "Earlier results must not be modified")
+}
+
+func TestMatch_InPlace(t *testing.T) {
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"n": 1},
+			map[string]interface{}{"n": 2},
+		},
+	}
+	ms, err := match("items[*].n", doc)
+	require.NoError(t, err)
+	result, err := ms.WithOptions(jsonmatch.MutationOptions{InPlace: true}).Set(10)
+	require.NoError(t, err)
+	assert.Equal(t, 10, doc["items"].([]interface{})[0].(map[string]interface{})["n"], "The input must be modified")
+	result.(map[string]interface{})["extra"] = true
+	assert.Equal(t, true, doc["extra"], "The input must be returned")
+
+	ms, err = match("items[*].n", doc)
+	require.NoError(t, err)
+	ms.WithOptions(jsonmatch.MutationOptions{InPlace: true, DryRun: true})
+	_, err = ms.Set(20)
+	require.NoError(t, err)
+	assert.Equal(t, 10, doc["items"].([]interface{})[0].(map[string]interface{})["n"], "Dry runs must not modify the input")
+}
+
+// largeArrayDocument returns a document holding an array of n items
+func largeArrayDocument(n int) map[string]interface{} {
+	items := make([]interface{}, n)
+	for i := range items {
+		items[i] = map[string]interface{}{"n": i}
+	}
+	return map[string]interface{}{"items": items}
+}
+
+// deepDocument returns a document with the array of items from largeArrayDocument
+// nested depth levels down, along with the path of the items
+func deepDocument(depth, n int) (interface{}, string) {
+	var doc interface{} = largeArrayDocument(n)
+	path := "items"
+	for i := 0; i < depth; i++ {
+		doc = map[string]interface{}{"level": doc}
+		path = "level." + path
+	}
+	return doc, path
+}
+
+func benchmarkMutation(b *testing.B, src string, doc interface{}, mutate func(ms *jsonmatch.MatchSet) error) {
+	ms, err := match(src, doc)
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mutate(ms); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func setTo(value interface{}) func(ms *jsonmatch.MatchSet) error {
+	return func(ms *jsonmatch.MatchSet) error {
+		_, err := ms.Set(value)
+		return err
+	}
+}
+
+func BenchmarkSet_LargeArrayItems(b *testing.B) {
+	benchmarkMutation(b, "items[*]", largeArrayDocument(100000), setTo(0))
+}
+
+func BenchmarkSet_LargeArrayFields(b *testing.B) {
+	benchmarkMutation(b, "items[*].n", largeArrayDocument(10000), setTo(0))
+}
+
+func BenchmarkMutate_LargeArrayFields(b *testing.B) {
+	benchmarkMutation(b, "items[*].n", largeArrayDocument(10000), func(ms *jsonmatch.MatchSet) error {
+		_, err := ms.Inc(1)
+		return err
+	})
+}
+
+func BenchmarkSet_LargeArrayFieldsInPlace(b *testing.B) {
+	ms, err := match("items[*].n", largeArrayDocument(10000))
+	require.NoError(b, err)
+	ms.WithOptions(jsonmatch.MutationOptions{InPlace: true})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ms.Set(i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSet_DeepDocument(b *testing.B) {
+	doc, path := deepDocument(50, 1000)
+	benchmarkMutation(b, path+"[*].n", doc, setTo(0))
+}
+
+func TestMatch_DeepCopy(t *testing.T) {
+	value := map[string]interface{}{"n": 1}
+	doc := map[string]interface{}{
+		"a":         map[string]interface{}{"b": 1},
+		"untouched": []interface{}{map[string]interface{}{"n": 2}},
+	}
+	ms, err := match("a.b", doc)
+	require.NoError(t, err)
+	result, err := ms.WithOptions(jsonmatch.MutationOptions{DeepCopy: true}).Set(value)
+	require.NoError(t, err)
+	resultMap := result.(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"b": value}, resultMap["a"])
+
+	resultMap["untouched"].([]interface{})[0].(map[string]interface{})["n"] = 3
+	resultMap["a"].(map[string]interface{})["b"].(map[string]interface{})["n"] = 4
+	assert.Equal(t, 2, doc["untouched"].([]interface{})[0].(map[string]interface{})["n"], "The input must not be shared")
+	assert.Equal(t, 1, value["n"], "Provided values must not be shared")
+}
+
+// cachedDocument returns a document of the kind that is shared between requests
+func cachedDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"rev":  1,
+		"tags": []interface{}{"a", "b", "c"},
+		"items": []interface{}{
+			map[string]interface{}{"_key": "x", "n": 1, "nested": map[string]interface{}{"n": 1}},
+			map[string]interface{}{"_key": "y", "n": 2, "nested": map[string]interface{}{"n": 2}},
+		},
+		"meta": map[string]interface{}{"title": "Cached", "text": "Hello"},
+	}
+}
+
+// Meant to be run with the race detector, which reports any writes to the shared
+// document
+func TestMatch_ConcurrentMutationsOfSharedDocument(t *testing.T) {
+	doc := cachedDocument()
+	mutations := []func() (interface{}, error){
+		func() (interface{}, error) {
+			ms, err := match("items[*].nested.n", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.Set(10)
+		},
+		func() (interface{}, error) {
+			ms, err := match("items[_key==\"x\"]", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.Delete()
+		},
+		func() (interface{}, error) { return jsonmatch.Move(doc, "meta.title", "meta.missing.path") },
+		func() (interface{}, error) { return jsonmatch.Copy(doc, "items[1]", "items[0]") },
+		func() (interface{}, error) {
+			ms, err := match("items[*].n", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.Inc(1)
+		},
+		func() (interface{}, error) {
+			ms, err := match("meta.text", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.RenameKey("body")
+		},
+		func() (interface{}, error) {
+			ms, err := match("tags[1:]", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.MutateRegions(func(_ string, regions [][]interface{}) ([][]interface{}, error) {
+				return [][]interface{}{{"d"}}, nil
+			})
+		},
+		func() (interface{}, error) {
+			return jsonmatch.Transaction(doc).
+				Set("meta.title", "Changed").
+				Inc("rev", 1).
+				Delete("tags[0]").
+				Commit()
+		},
+		func() (interface{}, error) {
+			ms, err := match("items[*]", doc)
+			if err != nil {
+				return nil, err
+			}
+			return ms.WithOptions(jsonmatch.MutationOptions{DryRun: true, RecordInverse: true}).Set(nil)
+		},
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		for _, mutation := range mutations {
+			wg.Add(1)
+			go func(mutation func() (interface{}, error)) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					_, err := mutation()
+					assert.NoError(t, err)
+				}
+			}(mutation)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, cachedDocument(), doc, "The shared document must not be modified")
+}
+
+func TestExpression_ConcurrentMatch(t *testing.T) {
+	expr, err := jsonmatch.Parse("items[n > 0][_key, nested.n]")
+	require.NoError(t, err)
+	doc := cachedDocument()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ms, err := expr.Match(doc)
+				if assert.NoError(t, err) {
+					assert.Equal(t, []interface{}{1, 2, "x", "y"}, ms.Values())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExpression_MatchAll(t *testing.T) {
+	expr, err := jsonmatch.Parse("n")
+	require.NoError(t, err)
+	docs := make([]interface{}, 100)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"n": i}
+	}
+	docs[42] = map[string]int{"n": 42}
+
+	results, err := expr.MatchAll(context.Background(), docs, 4)
+	require.NoError(t, err)
+	require.Equal(t, len(docs), len(results))
+	for i, result := range results {
+		if i == 42 {
+			assert.Error(t, result.Err, "Incompatible documents must fail on their own")
+			continue
+		}
+		require.NoError(t, result.Err)
+		assert.Equal(t, []interface{}{i}, result.MatchSet.Values(), "Results must be in the order of the documents")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = expr.MatchAll(ctx, docs, 0)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, results[0].Err)
+	assert.Nil(t, results[0].MatchSet)
+
+	// Documents being matched when the context is done stop as well
+	doc, _ := deepDocument(10, 100)
+	results, err = jsonmatch.MustParse("..n").MatchAll(&canceledAfter{Context: context.Background(), checks: 2}, []interface{}{doc}, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, results[0].Err)
+}
+
+// canceledAfter is a context that is canceled once its error has been checked a
+// number of times
+type canceledAfter struct {
+	context.Context
+	checks int32
+}
+
+func (ctx *canceledAfter) Err() error {
+	if atomic.AddInt32(&ctx.checks, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestExpression_MatchContext(t *testing.T) {
+	doc, _ := deepDocument(10, 100)
+	matchContext := func(ctx context.Context, src string, options jsonmatch.MatchOptions) (*jsonmatch.MatchSet, error) {
+		expr, err := jsonmatch.Parse(src)
+		require.NoError(t, err)
+		return expr.MatchContext(ctx, doc, options)
+	}
+
+	ms, err := matchContext(context.Background(), "..n", jsonmatch.MatchOptions{MaxDepth: 13, MaxNodes: 1000, MaxResults: 100})
+	require.NoError(t, err)
+	assert.Equal(t, 100, len(ms.Values()))
+	_, err = ms.Set(1)
+	assert.NoError(t, err, "The limits must not apply to mutations")
+
+	for _, test := range []struct {
+		options jsonmatch.MatchOptions
+		limit   string
+	}{
+		{jsonmatch.MatchOptions{MaxDepth: 5}, "MaxDepth"},
+		{jsonmatch.MatchOptions{MaxNodes: 50}, "MaxNodes"},
+		{jsonmatch.MatchOptions{MaxResults: 99}, "MaxResults"},
+	} {
+		_, err := matchContext(context.Background(), "..n", test.options)
+		limitErr, ok := err.(*jsonmatch.LimitError)
+		if assert.True(t, ok, "Expected a *LimitError for %s, got %v", test.limit, err) {
+			assert.Equal(t, test.limit, limitErr.Limit)
+			assert.NotEqual(t, "$", limitErr.Path, "Limits must stop the match where they are exceeded")
+		}
+	}
+
+	_, err = matchContext(context.Background(), "level..items[@ > 0]", jsonmatch.MatchOptions{MaxNodes: 50})
+	_, ok := err.(*jsonmatch.LimitError)
+	assert.True(t, ok, "Filter candidates must count as visited, got %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matchContext(ctx, "level", jsonmatch.MatchOptions{})
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = matchContext(ctx, "..n", jsonmatch.MatchOptions{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestExpression_ExistsFirstCount(t *testing.T) {
+	doc := cachedDocument()
+	doc["empty"] = nil
+	doc["matrix"] = []interface{}{[]interface{}{1, nil}, []interface{}{3}}
+	for _, src := range []string{
+		"rev", "missing", "empty", "items[*].n", "items[1].nested", "items[-1]._key",
+		"items[n > 1]", "items[n > 5]", "tags[1:]", "tags[0:3:2]", "tags[2:1:2]", "..n",
+		"..nested..n", "[meta, rev, meta]", "matrix[*][*]", "matrix[*][1]", "*", "@",
+		"items[_key == \"y\"].nested.n", "..[n == 2]._key", "[rev == 1]", "..{2}n", "..{,1}*",
+	} {
+		expr, err := jsonmatch.Parse(src)
+		require.NoError(t, err)
+		ms, err := expr.Match(doc)
+		require.NoError(t, err)
+		values := ms.Values()
+
+		exists, err := expr.Exists(doc)
+		require.NoError(t, err)
+		assert.Equal(t, len(values) > 0, exists, "Exists of %s", src)
+		count, err := expr.Count(doc)
+		require.NoError(t, err)
+		assert.Equal(t, len(values), count, "Count of %s", src)
+		first, found, err := expr.First(doc)
+		require.NoError(t, err)
+		assert.Equal(t, exists, found, "First of %s", src)
+		if found {
+			assert.Contains(t, values, first, "First of %s", src)
+		}
+	}
+
+	first, _, err := jsonmatch.MustParse("..n").First(doc)
+	require.NoError(t, err)
+	assert.Equal(t, 1, first, "First must visit the document depth first in key order")
+	doc["order"] = map[string]interface{}{
+		"a": map[string]interface{}{"b": map[string]interface{}{"z": "deep"}},
+		"b": map[string]interface{}{"z": "shallow"},
+	}
+	for src, expected := range map[string]interface{}{
+		"order..b.z":                        "deep",
+		"order..z":                          "deep",
+		"[tags[0], rev]":                    1,
+		"[items[1].n, items[0].nested.n]":   1,
+		"[order.b.z, order..b.z, \"text\"]": "deep",
+		"[\"text\", order.b.z]":             "shallow",
+	} {
+		first, found, err := jsonmatch.MustParse(src).First(doc)
+		require.NoError(t, err)
+		assert.True(t, found, src)
+		assert.Equal(t, expected, first, "First of %s must be the first match in document order", src)
+		value, _, err := jsonmatch.Get(doc, src)
+		require.NoError(t, err)
+		assert.Equal(t, expected, value, "Get of %s", src)
+	}
+}
+
+func BenchmarkExists_LargeDocument(b *testing.B) {
+	doc := largeArrayDocument(100000)
+	expr := jsonmatch.MustParse("items[n == 10]")
+	b.Run("Exists", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if found, err := expr.Exists(doc); err != nil || !found {
+				b.Fatal(found, err)
+			}
+		}
+	})
+	b.Run("Match", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ms, err := expr.Match(doc)
+			if err != nil || len(ms.Values()) == 0 {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetAndSet(t *testing.T) {
+	for _, path := range []string{
+		"rev", "missing", "meta.title", "meta.missing.deeper", "items[1].nested.n", "items[-1]._key",
+		"items[2]", "items[1].n.deeper", "tags[0]", "tags[-4]", "items[*].n", "items[n > 1]._key",
+		"meta['title']", "$", "[0]", "items.0", "items[+1]", "true", "tags[0].x",
+	} {
+		expr, err := jsonmatch.Parse(path)
+		if err != nil {
+			_, _, getErr := jsonmatch.Get(cachedDocument(), path)
+			assert.Error(t, getErr, "Get of %s", path)
+			continue
+		}
+		value, found, err := jsonmatch.Get(cachedDocument(), path)
+		require.NoError(t, err)
+		expectedValue, expectedFound, err := expr.First(cachedDocument())
+		require.NoError(t, err)
+		assert.Equal(t, expectedFound, found, "Get of %s", path)
+		assert.Equal(t, expectedValue, value, "Get of %s", path)
+
+		doc := cachedDocument()
+		result, err := jsonmatch.Set(doc, path, "new")
+		ms, matchErr := expr.Match(cachedDocument())
+		require.NoError(t, matchErr)
+		expected, expectedErr := ms.Set("new")
+		assert.Equal(t, expectedErr, err, "Set of %s", path)
+		assert.Equal(t, expected, result, "Set of %s", path)
+		assert.Equal(t, cachedDocument(), doc, "Set of %s must not modify the input", path)
+	}
+}
+
+func BenchmarkGet_SimplePath(b *testing.B) {
+	doc := cachedDocument()
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, found, _ := jsonmatch.Get(doc, "items[1].nested.n"); !found {
+				b.Fatal("Not found")
+			}
+		}
+	})
+	b.Run("Match", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if ms, _ := jsonmatch.Match("items[1].nested.n", doc); len(ms.Values()) == 0 {
+				b.Fatal("Not found")
+			}
+		}
+	})
+}
+
+func BenchmarkSet_SimplePath(b *testing.B) {
+	doc := cachedDocument()
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := jsonmatch.Set(doc, "items[1].nested.n", i); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Match", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ms, _ := jsonmatch.Match("items[1].nested.n", doc)
+			if _, err := ms.Set(i); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTypedAccessors(t *testing.T) {
+	doc := map[string]interface{}{
+		"count":   json.Number("3"),
+		"ratio":   json.Number("0.5"),
+		"big":     uint64(1) << 63,
+		"precise": int64(1)<<53 + 1,
+		"tenth":   0.1,
+		"decoded": json.Number("0.30000000000000001"),
+		"huge":    1e300,
+		"whole":   2.0,
+		"name":    "Ghost",
+		"flags":   []interface{}{true, false},
+		"numbers": []interface{}{1, 2.0, json.Number("3"), int8(4)},
+		"mixed":   []interface{}{1, "two"},
+	}
+
+	count, found, err := jsonmatch.GetAs[int](doc, "count")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 3, count)
+
+	ratio, _, err := jsonmatch.GetAs[float64](doc, "ratio")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, ratio)
+
+	single, _, err := jsonmatch.GetAs[float32](doc, "ratio")
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.5), single)
+
+	precise, _, err := jsonmatch.GetAs[int64](doc, "precise")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1)<<53+1, precise)
+
+	// Floats are read to the nearest float, as floatFromValue does
+	rounded, _, err := jsonmatch.GetAs[float64](doc, "precise")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1<<53), rounded)
+	tenth, _, err := jsonmatch.GetAs[float32](doc, "tenth")
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.1), tenth)
+	decoded, _, err := jsonmatch.GetAs[float64](doc, "decoded")
+	require.NoError(t, err)
+	assert.Equal(t, 0.3, decoded)
+
+	whole, _, err := jsonmatch.GetAs[int64](doc, "whole")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), whole)
+
+	number, _, err := jsonmatch.GetAs[json.Number](doc, "whole")
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("2"), number)
+
+	flags, _, err := jsonmatch.GetAs[[]interface{}](doc, "flags")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{true, false}, flags)
+
+	_, found, err = jsonmatch.GetAs[string](doc, "missing")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	for _, test := range []struct {
+		path string
+		get  func() error
+	}{
+		{"ratio", func() error { _, _, err := jsonmatch.GetAs[int](doc, "ratio"); return err }},
+		{"big", func() error { _, _, err := jsonmatch.GetAs[int64](doc, "big"); return err }},
+		{"name", func() error { _, _, err := jsonmatch.GetAs[float64](doc, "name"); return err }},
+		{"huge", func() error { _, _, err := jsonmatch.GetAs[float32](doc, "huge"); return err }},
+		{"decoded", func() error { _, _, err := jsonmatch.GetAs[int](doc, "decoded"); return err }},
+		{"count", func() error { _, _, err := jsonmatch.GetAs[string](doc, "count"); return err }},
+	} {
+		typeErr, ok := test.get().(*jsonmatch.TypeError)
+		if assert.True(t, ok, "Expected a *TypeError for %s", test.path) {
+			assert.Equal(t, test.path, typeErr.Path)
+		}
+	}
+
+	ms, err := match("numbers[*]", doc)
+	require.NoError(t, err)
+	numbers, err := jsonmatch.ValuesAs[float64](ms)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1, 2, 3, 4}, numbers)
+
+	result, err := jsonmatch.MutateAs(ms, func(_ string, n int) (int, error) {
+		return n * 10, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 20, 30, 40}, result.(map[string]interface{})["numbers"])
+
+	ms, err = match("mixed[*]", doc)
+	require.NoError(t, err)
+	_, err = jsonmatch.ValuesAs[int](ms)
+	typeErr, ok := err.(*jsonmatch.TypeError)
+	require.True(t, ok, "Expected a *TypeError, got %v", err)
+	assert.Equal(t, "$.mixed[000001]", typeErr.Path)
+	assert.Equal(t, "two", typeErr.Value)
+
+	ms.WithOptions(jsonmatch.MutationOptions{ErrorPolicy: jsonmatch.ApplyValid})
+	_, err = jsonmatch.MutateAs(ms, func(_ string, n int) (int, error) {
+		return n + 1, nil
+	})
+	multiErr, ok := err.(*jsonmatch.MultiError)
+	require.True(t, ok, "Expected a *MultiError, got %v", err)
+	_, ok = multiErr.Errors[0].Err.(*jsonmatch.TypeError)
+	assert.True(t, ok, "Conversion errors must be a *TypeError")
+}
+
+func TestMatch_CompiledFilters(t *testing.T) {
+	type name string
+	type object map[string]interface{}
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"v": 1},
+			map[string]interface{}{"v": 2.5},
+			map[string]interface{}{"v": json.Number("3")},
+			map[string]interface{}{"v": "3"},
+			map[string]interface{}{"v": name("b")},
+			map[string]interface{}{"v": nil},
+			map[string]interface{}{"v": []interface{}{1}},
+			map[string]interface{}{"w": 1},
+			object{"v": "a"},
+			"v",
+			nil,
+			2,
+		},
+	}
+	for src, count := range map[string]int{
+		"items[v == 3]":       1,
+		"items[v != 3]":       2,
+		"items[v < 3]":        2,
+		"items[v <= 3]":       3,
+		"items[v > 1]":        2,
+		"items[v >= 2.5]":     2,
+		"items[v == \"3\"]":   1,
+		"items[v != \"3\"]":   2,
+		"items[v > \"a\"]":    1,
+		"items[@.v <= \"a\"]": 2,
+		"items[v?]":           7,
+		"items[@ == 2]":       1,
+		"items[@ != \"v\"]":   0,
+		"items[@?]":           12,
+	} {
+		expr := jsonmatch.MustParse(src)
+		ms, err := expr.Match(doc)
+		require.NoError(t, err)
+		assert.Len(t, ms.Values(), count, src)
+		// Matching with limits evaluates the filters without the comparators
+		ms, err = expr.MatchContext(context.Background(), doc, jsonmatch.MatchOptions{MaxNodes: 1000})
+		require.NoError(t, err)
+		assert.Len(t, ms.Values(), count, src)
+	}
+}
+
+// sanityDocument returns an article in the shape of a typical Sanity document, with
+// a portable text body of the given number of blocks
+func sanityDocument(blocks int) map[string]interface{} {
+	body := make([]interface{}, 0, blocks)
+	for i := 0; i < blocks; i++ {
+		style := "normal"
+		if i%5 == 0 {
+			style = "h2"
+		}
+		body = append(body, map[string]interface{}{
+			"_type":    "block",
+			"_key":     fmt.Sprintf("block%d", i),
+			"style":    style,
+			"markDefs": []interface{}{map[string]interface{}{"_type": "link", "_key": "l1", "href": "https://example.com"}},
+			"children": []interface{}{
+				map[string]interface{}{"_type": "span", "_key": "s1", "text": "Some text ", "marks": []interface{}{}},
+				map[string]interface{}{"_type": "span", "_key": "s2", "text": "with a link", "marks": []interface{}{"l1"}},
+			},
+		})
+		if i%10 == 0 {
+			body = append(body, map[string]interface{}{
+				"_type": "image",
+				"_key":  fmt.Sprintf("image%d", i),
+				"asset": map[string]interface{}{"_type": "reference", "_ref": fmt.Sprintf("image-%d-jpg", i)},
+			})
+		}
+	}
+	return map[string]interface{}{
+		"_id":         "article-1",
+		"_type":       "article",
+		"_rev":        "abc123",
+		"title":       "A typical article",
+		"slug":        map[string]interface{}{"_type": "slug", "current": "a-typical-article"},
+		"author":      map[string]interface{}{"_type": "reference", "_ref": "author-1"},
+		"categories":  []interface{}{map[string]interface{}{"_type": "reference", "_ref": "category-1", "_key": "c1"}},
+		"publishedAt": "2020-01-01T00:00:00Z",
+		"rating":      4.5,
+		"body":        body,
+	}
+}
+
+func BenchmarkMatch_SanityDocument(b *testing.B) {
+	doc := sanityDocument(100)
+	for _, src := range []string{
+		"title",
+		"body[_type == \"block\"].children[*].text",
+		"body[style == \"h2\"]",
+		"body[_key == \"block50\"].children[marks[0] == \"l1\"]",
+		"..[_type == \"reference\"]._ref",
+	} {
+		expr := jsonmatch.MustParse(src)
+		b.Run(src, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := expr.Match(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatch_LargeSelection(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		doc := largeArrayDocument(n)
+		for _, src := range []string{"items[*].n", "items[n >= 0]", "[items[0:10], items[-10:], items[5]]"} {
+			expr := jsonmatch.MustParse(src)
+			b.Run(fmt.Sprintf("%d/%s", n, src), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := expr.Match(doc); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMatch_RecursiveDescent(b *testing.B) {
+	doc := sanityDocument(2000)
+	for _, src := range []string{"..[_type == \"reference\"]", "..{1,2}_type", "..*"} {
+		expr := jsonmatch.MustParse(src)
+		b.Run(src, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := expr.Match(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// projection is a set of expressions sharing prefixes, as used for projections
+var projection = []string{
+	"_id",
+	"title",
+	"title",
+	"slug.current",
+	"author._ref",
+	"meta.tags",
+	"[_id, _rev]",
+	"body[_type == \"block\"]._key",
+	"body[_type == \"block\"].children[*].text",
+	"body[_type == \"block\"].children[marks[0] == \"l1\"]._key",
+	"body[_type == \"block\"].markDefs[*].href",
+	"body[_type == \"image\"].asset._ref",
+	"body[style == \"h2\"].children[0].text",
+	"body[0:3]._key",
+	"body..[_type == \"reference\"]._ref",
+	"body..{1,2}_type",
+	"body..href",
+	"..[_type == \"reference\"]",
+	"..marks[*]",
+	"$",
+}
+
+func TestQuerySet_Match(t *testing.T) {
+	doc := sanityDocument(20)
+	exprs := make([]*jsonmatch.Expression, len(projection))
+	for i, src := range projection {
+		exprs[i] = jsonmatch.MustParse(src)
+	}
+	sets, err := jsonmatch.NewQuerySet(exprs...).Match(doc)
+	require.NoError(t, err)
+	require.Len(t, sets, len(projection))
+	for i, expr := range exprs {
+		ms, err := expr.Match(doc)
+		require.NoError(t, err)
+		assert.Equal(t, ms.Values(), sets[i].Values(), projection[i])
+	}
+
+	sets, err = jsonmatch.NewQuerySet().Match(doc)
+	require.NoError(t, err)
+	assert.Len(t, sets, 0)
+}
+
+func TestQuerySet_IndependentMatchSets(t *testing.T) {
+	doc := sanityDocument(2)
+	qs := jsonmatch.NewQuerySet(
+		jsonmatch.MustParse("title"),
+		jsonmatch.MustParse("title"),
+		jsonmatch.MustParse("slug.current"),
+		jsonmatch.MustParse("meta.tags"),
+		jsonmatch.MustParse("body[_type == \"image\"]"),
+	)
+	sets, err := qs.Match(doc)
+	require.NoError(t, err)
+
+	retitled, err := sets[1].Set("Another article")
+	require.NoError(t, err)
+	assert.Equal(t, "Another article", retitled.(map[string]interface{})["title"])
+	assert.Equal(t, []interface{}{"A typical article"}, sets[0].Values())
+	assert.Equal(t, []interface{}{"Another article"}, sets[1].Values())
+
+	sets[2].WithOptions(jsonmatch.MutationOptions{ReportChanges: true})
+	_, err = sets[2].Set("another-article")
+	require.NoError(t, err)
+	assert.Len(t, sets[2].Changes(), 1)
+	sets[0].WithOptions(jsonmatch.MutationOptions{ReportChanges: true})
+	assert.Len(t, sets[0].Changes(), 0)
+
+	tagged, err := sets[3].Set([]interface{}{"news"})
+	require.NoError(t, err)
+	assert.Equal(t, "A typical article", tagged.(map[string]interface{})["title"])
+	assert.Equal(t, map[string]interface{}{"tags": []interface{}{"news"}}, tagged.(map[string]interface{})["meta"])
+	assert.Equal(t, "A typical article", doc["title"])
+	assert.Nil(t, doc["meta"])
+
+	withoutImages, err := sets[4].Delete()
+	require.NoError(t, err)
+	assert.Len(t, withoutImages.(map[string]interface{})["body"], 2)
+	assert.Len(t, doc["body"], 3)
+}
+
+func TestQuerySet_MutationsOfOneMatchSet(t *testing.T) {
+	sources := []string{"title", "..", "@", "..[_type == \"reference\"]._ref", "slug.current"}
+	exprs := make([]*jsonmatch.Expression, len(sources))
+	for i, src := range sources {
+		exprs[i] = jsonmatch.MustParse(src)
+	}
+	for mutated := range sources {
+		doc := sanityDocument(2)
+		sets, err := jsonmatch.NewQuerySet(exprs...).Match(doc)
+		require.NoError(t, err)
+		_, err = sets[mutated].Set("changed")
+		require.NoError(t, err)
+		for i, expr := range exprs {
+			if i == mutated {
+				continue
+			}
+			expected, err := expr.Match(doc)
+			require.NoError(t, err)
+			assert.Equal(t, expected.Values(), sets[i].Values(), "%s after setting %s", sources[i], sources[mutated])
+			want, err := expected.Set("again")
+			require.NoError(t, err)
+			got, err := sets[i].Set("again")
+			require.NoError(t, err)
+			assert.Equal(t, want, got, "%s after setting %s", sources[i], sources[mutated])
+		}
+	}
+}
+
+func BenchmarkQuerySet_Projection(b *testing.B) {
+	doc := sanityDocument(100)
+	exprs := make([]*jsonmatch.Expression, len(projection))
+	for i, src := range projection {
+		exprs[i] = jsonmatch.MustParse(src)
+	}
+	b.Run("QuerySet", func(b *testing.B) {
+		qs := jsonmatch.NewQuerySet(exprs...)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := qs.Match(doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Expressions", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, expr := range exprs {
+				if _, err := expr.Match(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -12,12 +12,56 @@ import (
 type ParseError struct {
 	Message string
 	Pos     int
+	// The name of the exceeded limit of the ParseOptions, as in "MaxDepth", or
+	// the empty string for syntax errors
+	Limit string
 }
 
 func (e *ParseError) Error() string {
 	return e.Message
 }
 
+// ParseOptions limit the size and complexity of the expressions accepted by the
+// parser. Zero values use the limits of DefaultParseOptions, negative values
+// disable the limit.
+type ParseOptions struct {
+	// MaxLength is the maximum length of the expression in bytes
+	MaxLength int
+	// MaxDepth is the maximum nesting depth of brackets
+	MaxDepth int
+	// MaxUnionMembers is the maximum number of members of each union, as in
+	// `[a, b, c]`
+	MaxUnionMembers int
+	// MaxNodes is the maximum number of nodes in the parsed expression
+	MaxNodes int
+}
+
+// DefaultParseOptions are the limits used by Parse and NewParser. They are
+// generous for any expression written by hand.
+var DefaultParseOptions = ParseOptions{
+	MaxLength:       64 * 1024,
+	MaxDepth:        64,
+	MaxUnionMembers: 1024,
+	MaxNodes:        16 * 1024,
+}
+
+// withDefaults fills in the default value of each limit that is not set
+func (o ParseOptions) withDefaults() ParseOptions {
+	if o.MaxLength == 0 {
+		o.MaxLength = DefaultParseOptions.MaxLength
+	}
+	if o.MaxDepth == 0 {
+		o.MaxDepth = DefaultParseOptions.MaxDepth
+	}
+	if o.MaxUnionMembers == 0 {
+		o.MaxUnionMembers = DefaultParseOptions.MaxUnionMembers
+	}
+	if o.MaxNodes == 0 {
+		o.MaxNodes = DefaultParseOptions.MaxNodes
+	}
+	return o
+}
+
 // Parser represents a JSONpath parser
 type Parser struct {
 	s   *Scanner
@@ -27,6 +71,18 @@ type Parser struct {
 		pos int
 		n   int
 	}
+	options ParseOptions
+	// The current nesting depth of brackets
+	depth int
+}
+
+// limitError returns a ParseError for the exceeded limit
+func limitError(limit string, max, pos int) *ParseError {
+	return &ParseError{
+		Pos:     pos,
+		Limit:   limit,
+		Message: fmt.Sprintf("Expression exceeds the %s limit of %d", limit, max),
+	}
 }
 
 // MustParse parses a JSONPath expression, and panics on failure.
@@ -38,14 +94,30 @@ func MustParse(src string) *Expression {
 	return expr
 }
 
-// NewParser returns a new instance of Parser.
+// NewParser returns a new instance of Parser using the DefaultParseOptions.
 func NewParser(r io.Reader) *Parser {
-	return &Parser{s: NewScanner(r)}
+	return NewParserWithOptions(r, DefaultParseOptions)
+}
+
+// NewParserWithOptions returns a new instance of Parser using the limits of the
+// options.
+func NewParserWithOptions(r io.Reader, options ParseOptions) *Parser {
+	return &Parser{s: NewScanner(r), options: options.withDefaults()}
 }
 
 // Parse the provided string returning its compiled representation
 func Parse(src string) (*Expression, error) {
-	return NewParser(bytes.NewReader([]byte(src))).Parse()
+	return ParseWithOptions(src, DefaultParseOptions)
+}
+
+// ParseWithOptions parses the provided string like Parse, but with the limits of
+// the options. A *ParseError naming the limit is returned if any is exceeded.
+func ParseWithOptions(src string, options ParseOptions) (*Expression, error) {
+	options = options.withDefaults()
+	if options.MaxLength > 0 && len(src) > options.MaxLength {
+		return nil, limitError("MaxLength", options.MaxLength, options.MaxLength)
+	}
+	return NewParserWithOptions(bytes.NewReader([]byte(src)), options).Parse()
 }
 
 // Parse executes the parser
@@ -55,6 +127,10 @@ func (p *Parser) Parse() (*Expression, error) {
 		return nil, err
 	}
 	tok, _, pos := p.scan()
+	if max := p.options.MaxLength; max > 0 && pos > max {
+		// Readers can not be measured up front
+		return nil, limitError("MaxLength", max, max)
+	}
 	if tok != EOF {
 		return nil, &ParseError{
 			Pos:     pos,
@@ -65,7 +141,10 @@ func (p *Parser) Parse() (*Expression, error) {
 	if !any {
 		result = &selfNode{pos: 0}
 	}
-	return &Expression{root: result}, nil
+	if max := p.options.MaxNodes; max > 0 && countNodes(result) > max {
+		return nil, limitError("MaxNodes", max, 0)
+	}
+	return &Expression{root: result, plan: compileRoot(result)}, nil
 }
 
 // scan returns the next token from the underlying scanner.
@@ -130,6 +209,9 @@ func (p *Parser) parseExpression() (node, error) {
 		}
 		if any {
 			result.nodes = append(result.nodes, path)
+			if max := p.options.MaxUnionMembers; max > 0 && len(result.nodes) > max {
+				return nil, limitError("MaxUnionMembers", max, path.position())
+			}
 		}
 
 		token, literal, pos := p.scan()
@@ -277,7 +359,12 @@ func (p *Parser) parsePath() (node, bool, error) {
 			}
 
 			// Parse the innards
+			p.depth++
+			if max := p.options.MaxDepth; max > 0 && p.depth > max {
+				return nil, false, limitError("MaxDepth", max, pos)
+			}
 			expr, err := p.parseExpression()
+			p.depth--
 			if err != nil {
 				return nil, false, err
 			}
@@ -319,7 +406,11 @@ func (p *Parser) parsePath() (node, bool, error) {
 			// After this points, no naked integers allowed
 			noNakedIntegers = true
 		case DotDot:
-			result.nodes = append(result.nodes, &recursiveNode{pos: pos})
+			recursive := &recursiveNode{pos: pos}
+			if err := p.parseDepthBounds(recursive); err != nil {
+				return nil, false, err
+			}
+			result.nodes = append(result.nodes, recursive)
 			token, text, aPos := p.scan()
 			// If the first token following a recursive, is a field, we parse it as a existingFieldNode
 			// to guard against malcovich-malcovich scenarios where you want to update all values in a document
@@ -360,6 +451,68 @@ func (p *Parser) parsePath() (node, bool, error) {
 	return unwrapIfSingleNodeList(result), true, nil
 }
 
+// parseDepthBounds parses the optional bounds of the levels matched by a recursive
+// descent, as in `..{1,3}`. Either bound may be left out, as in `..{2,}` or
+// `..{,3}`, and a single level is given as `..{2}`.
+func (p *Parser) parseDepthBounds(n *recursiveNode) error {
+	token, _, pos := p.scan()
+	if token != BraceLeft {
+		p.unscan()
+		return nil
+	}
+	min, minSpecified, err := p.parseDepth()
+	if err != nil {
+		return err
+	}
+	token, _, pos = p.scan()
+	if token == BraceRight && minSpecified {
+		n.minDepth, n.maxDepth, n.maxDepthSpecified = min, min, true
+		return nil
+	}
+	if token != Comma {
+		return &ParseError{
+			Message: "Expected depth bounds as in '..{1,3}'",
+			Pos:     pos,
+		}
+	}
+	max, maxSpecified, err := p.parseDepth()
+	if err != nil {
+		return err
+	}
+	token, _, pos = p.scan()
+	if token != BraceRight {
+		return &ParseError{
+			Message: "'}' must appear",
+			Pos:     pos,
+		}
+	}
+	if maxSpecified && max < min {
+		return &ParseError{
+			Message: "The maximum depth must not be less than the minimum depth",
+			Pos:     pos,
+		}
+	}
+	n.minDepth, n.maxDepth, n.maxDepthSpecified = min, max, maxSpecified
+	return nil
+}
+
+// parseDepth parses one of the optional bounds of parseDepthBounds
+func (p *Parser) parseDepth() (int, bool, error) {
+	token, text, pos := p.scan()
+	if token != Integer {
+		p.unscan()
+		return 0, false, nil
+	}
+	depth, err := strconv.Atoi(text)
+	if err != nil || depth < 0 {
+		return 0, false, &ParseError{
+			Message: fmt.Sprintf("Invalid depth %s", text),
+			Pos:     pos,
+		}
+	}
+	return depth, true, nil
+}
+
 // Parses one complete JSONpath expression
 func (p *Parser) parseAtom() (node, bool) {
 	token, text, pos := p.scan()
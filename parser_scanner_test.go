@@ -3,12 +3,14 @@ package jsonmatch_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -81,3 +83,75 @@ func TestReferencePaths(t *testing.T) {
 		assert.Fail(t, "Tests failed verifying JSONpath scanner and parser")
 	}
 }
+
+func TestParse_Limits(t *testing.T) {
+	for _, test := range []struct {
+		src     string
+		options jsonmatch.ParseOptions
+		limit   string
+	}{
+		{strings.Repeat("a.", 100) + "a", jsonmatch.ParseOptions{MaxLength: 100}, "MaxLength"},
+		{strings.Repeat("[", 100000) + strings.Repeat("]", 100000), jsonmatch.ParseOptions{MaxLength: -1}, "MaxDepth"},
+		{"a[b[c[d]]]", jsonmatch.ParseOptions{MaxDepth: 2}, "MaxDepth"},
+		{"[a, b, c, d]", jsonmatch.ParseOptions{MaxUnionMembers: 3}, "MaxUnionMembers"},
+		{"a.b.c.d[e == 1]", jsonmatch.ParseOptions{MaxNodes: 5}, "MaxNodes"},
+	} {
+		_, err := jsonmatch.ParseWithOptions(test.src, test.options)
+		parseErr, ok := err.(*jsonmatch.ParseError)
+		if assert.True(t, ok, "Expected a *ParseError for %s, got %v", test.limit, err) {
+			assert.Equal(t, test.limit, parseErr.Limit)
+		}
+	}
+
+	_, err := jsonmatch.Parse(strings.Repeat("[", 1000))
+	parseErr, ok := err.(*jsonmatch.ParseError)
+	require.True(t, ok, "Parse must apply the default limits")
+	assert.Equal(t, "MaxDepth", parseErr.Limit)
+
+	_, err = jsonmatch.ParseWithOptions("a[b[c[d]]]", jsonmatch.ParseOptions{MaxDepth: 3, MaxNodes: -1})
+	assert.NoError(t, err)
+
+	_, err = jsonmatch.NewParserWithOptions(strings.NewReader("abcdef"), jsonmatch.ParseOptions{MaxLength: 3}).Parse()
+	parseErr, ok = err.(*jsonmatch.ParseError)
+	require.True(t, ok, "Readers must be limited as well")
+	assert.Equal(t, "MaxLength", parseErr.Limit)
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"a.b.c",
+		"employees[1:3, 9, 12].name",
+		"..[_key == \"x\"].title",
+		"[?(@.price < 10)]",
+		"items[-1:0:-2]",
+		"a['quoted key'][\"literal\"]",
+		"[[[[[[",
+		"a == b == c",
+		"0.",
+		"a.b[2:1:2]",
+		"a.b[5:0:-1]",
+		"items..*[?(@ > 1)]",
+	} {
+		f.Add(seed)
+	}
+	doc := map[string]interface{}{
+		"a":     map[string]interface{}{"b": []interface{}{1, "two", map[string]interface{}{"c": 3.5}}},
+		"items": []interface{}{map[string]interface{}{"_key": "x", "title": "X"}},
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		expr, err := jsonmatch.Parse(src)
+		if err != nil {
+			return
+		}
+		// Expressions that parse must be safe to evaluate, and bounded by the limits
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ms, err := expr.MatchContext(ctx, doc, jsonmatch.MatchOptions{MaxDepth: 16, MaxNodes: 1000, MaxResults: 100})
+		if err == context.DeadlineExceeded {
+			t.Fatalf("Matching %q did not stop at the limits", src)
+		}
+		if err == nil {
+			ms.Values()
+		}
+	})
+}
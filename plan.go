@@ -0,0 +1,350 @@
+package jsonmatch
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// step is a node of an expression compiled for evaluation. Everything that does
+// not depend on the document, such as field names, slice bounds and literals, is
+// worked out when compiling, so the same steps are evaluated against every
+// document without looking at the nodes again. Steps hold no state of their own
+// and may be evaluated from several goroutines at once.
+type step func(input Ref) (Ref, error)
+
+// compile compiles the node into the step evaluating it, equivalent to process
+func compile(root node) step {
+	switch n := root.(type) {
+	case *pathNode:
+		return compilePath(n, nil)
+	case *stringNode:
+		literal := NewLiteralRef(n.value)
+		return func(input Ref) (Ref, error) {
+			return literal, nil
+		}
+	case *intNode:
+		literal := NewLiteralRef(n.value)
+		return func(input Ref) (Ref, error) {
+			return literal, nil
+		}
+	case *floatNode:
+		literal := NewLiteralRef(n.value)
+		return func(input Ref) (Ref, error) {
+			return literal, nil
+		}
+	case *fieldNode:
+		name := n.name
+		return func(input Ref) (Ref, error) {
+			return processFieldSelection(input, name, false)
+		}
+	case *existingFieldNode:
+		name := n.name
+		return func(input Ref) (Ref, error) {
+			return processFieldSelection(input, name, true)
+		}
+	case *indexNode:
+		return func(input Ref) (Ref, error) {
+			return processIndex(input, n)
+		}
+	case *sliceNode:
+		bounds := newSliceBounds(n)
+		return func(input Ref) (Ref, error) {
+			return sliceItems(input, bounds)
+		}
+	case *filterNode:
+		return compileFilter(n).evaluate
+	case *wildcardNode:
+		return func(input Ref) (Ref, error) {
+			return processWildcard(input, n)
+		}
+	case *recursiveNode:
+		return func(input Ref) (Ref, error) {
+			return processRecursive(input, n)
+		}
+	case *unionNode:
+		members := make([]step, len(n.nodes))
+		for i, member := range n.nodes {
+			members[i] = compile(member)
+		}
+		return func(input Ref) (Ref, error) {
+			var result []Ref
+			for _, member := range members {
+				subset, err := member(input)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, subset)
+			}
+			return NewUnionRef(result...), nil
+		}
+	case *selfNode:
+		return func(input Ref) (Ref, error) {
+			return input, nil
+		}
+	}
+	err := fmt.Errorf("unexpected node %v", root)
+	return func(input Ref) (Ref, error) {
+		return nil, err
+	}
+}
+
+// compileRoot compiles the root node of an expression. The step matching the
+// results of the expression is the last, and is wrapped by limitResults.
+func compileRoot(root node) step {
+	last := root
+	path, isPath := root.(*pathNode)
+	if isPath && len(path.nodes) > 0 {
+		last = path.nodes[len(path.nodes)-1]
+	}
+	if _, isSelf := last.(*selfNode); isSelf || isPath && len(path.nodes) == 0 {
+		// Matches the values it is given, which there is no work in
+		return compile(root)
+	}
+	if isPath {
+		return compilePath(path, limitResults)
+	}
+	return limitResults(compile(root))
+}
+
+// compilePath compiles the nodes of the path into one step evaluating them in
+// sequence. If last is given, it wraps the step of the last node.
+func compilePath(list *pathNode, last func(step) step) step {
+	steps := make([]step, len(list.nodes))
+	// Whether the step follows a recursive descent, see processPath
+	afterRecursive := make([]bool, len(list.nodes))
+	for i, n := range list.nodes {
+		steps[i] = compile(n)
+		if i > 0 {
+			_, afterRecursive[i] = list.nodes[i-1].(*recursiveNode)
+		}
+	}
+	if last != nil && len(steps) > 0 {
+		steps[len(steps)-1] = last(steps[len(steps)-1])
+	}
+	return func(input Ref) (Ref, error) {
+		var err error
+		result := input
+		for i, s := range steps {
+			result, err = s(result)
+			if err != nil {
+				return nil, err
+			}
+			if afterRecursive[i] {
+				// Never offer to create missing values in every container of the document
+				result = withoutLatentRefs(result)
+			}
+		}
+		return result, nil
+	}
+}
+
+// limitResults wraps the step matching the results of an expression. Evaluations
+// with a MaxResults limit evaluate the step for one variable of the input at a
+// time, and stop as soon as there are too many results, rather than once they
+// have all been matched.
+func limitResults(s step) step {
+	return func(input Ref) (Ref, error) {
+		e := evaluationOf(input)
+		if e == nil || e.options.MaxResults <= 0 {
+			return s(input)
+		}
+		max := e.options.MaxResults
+		var results []Ref
+		if latent := latentMapRefs(input); len(latent) > 0 {
+			// Extended by the step all the same, but never holding any values
+			refs := make([]Ref, len(latent))
+			for i, r := range latent {
+				refs[i] = r
+			}
+			result, err := s(NewUnionRef(refs...))
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+		total := 0
+		for _, v := range input.Vars() {
+			result, err := s(v)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+			total += result.EstimateSize()
+			if total > max {
+				// Values matched through several variables only count once
+				merged := NewUnionRef(results...)
+				results, total = []Ref{merged}, merged.EstimateSize()
+				if total > max {
+					return nil, &LimitError{Limit: "MaxResults", Max: max, Path: v.id()}
+				}
+			}
+		}
+		return NewUnionRef(results...), nil
+	}
+}
+
+// evaluationOf returns the evaluation in progress for the variables of the ref
+func evaluationOf(ref Ref) *evaluation {
+	for _, r := range individualRefs(ref) {
+		switch t := r.(type) {
+		case *VarRef:
+			return t.evaluation
+		case *ArrayRef:
+			return t.variable.evaluation
+		case *MapRef:
+			return t.variable.evaluation
+		}
+	}
+	return nil
+}
+
+// filterPlan is a compiled filter. Filters comparing a field of the candidate, or
+// the candidate itself, with a literal, as in `[_type == "block"]`, are tested by
+// looking the value up directly and comparing it with a comparator for the type of
+// the literal. Anything else is tested by evaluating both sides like testFilter.
+type filterPlan struct {
+	node *filterNode
+	lhs  step
+	rhs  step
+	// Whether the lhs is a field of the candidate or the candidate itself
+	direct bool
+	// Whether the lhs is the candidate itself, otherwise it is the field
+	self  bool
+	field string
+	// Compares the lhs value with the literal, ok is false if it can not
+	compare func(value interface{}) (result, ok bool)
+}
+
+func compileFilter(node *filterNode) *filterPlan {
+	plan := &filterPlan{node: node, lhs: compile(node.lhs)}
+	// unary operators have no rhs
+	if node.rhs != nil {
+		plan.rhs = compile(node.rhs)
+	}
+	lhs := node.lhs
+	if path, ok := lhs.(*pathNode); ok && len(path.nodes) == 2 {
+		if _, isSelf := path.nodes[0].(*selfNode); isSelf {
+			lhs = path.nodes[1]
+		}
+	}
+	switch t := lhs.(type) {
+	case *fieldNode:
+		plan.field, plan.direct = t.name, true
+	case *existingFieldNode:
+		plan.field, plan.direct = t.name, true
+	case *selfNode:
+		plan.direct, plan.self = true, true
+	}
+	if node.operator == Exists {
+		plan.compare = func(value interface{}) (bool, bool) {
+			return true, true
+		}
+		return plan
+	}
+	switch rhs := node.rhs.(type) {
+	case *stringNode:
+		plan.compare = compareString(node.operator, rhs.value)
+	case *intNode:
+		plan.compare = compareFloat(node.operator, float64(rhs.value))
+	case *floatNode:
+		plan.compare = compareFloat(node.operator, rhs.value)
+	}
+	return plan
+}
+
+// evaluate matches the children of the input that pass the filter
+func (plan *filterPlan) evaluate(input Ref) (Ref, error) {
+	return filterChildren(input, plan.node, plan.test)
+}
+
+// test tests a candidate against the filter
+func (plan *filterPlan) test(candidate filterCandidate) (bool, error) {
+	// Evaluations limiting the values visited take the long way, which accounts for
+	// every value visited
+	if plan.direct && plan.compare != nil && !candidate.parent.evaluation.limitsVisits() {
+		value := candidate.value
+		if !plan.self {
+			m, isMap := value.(map[string]interface{})
+			if isMap && m[plan.field] == nil || !isMap && isScalar(value) {
+				// Members holding nil have no value to compare, and scalars have no fields
+				return false, nil
+			}
+			value = m[plan.field]
+		}
+		if value != nil {
+			if result, ok := plan.compare(value); ok {
+				return result, nil
+			}
+		}
+	}
+	lhs, err := plan.lhs(candidate.ref())
+	if err != nil {
+		return false, err
+	}
+	var rhs Ref
+	if plan.rhs != nil {
+		rhs, err = plan.rhs(candidate.ref())
+		if err != nil {
+			return false, err
+		}
+	}
+	return applyFilter(lhs, rhs, plan.node)
+}
+
+// isScalar is true for the scalar values of decoded JSON documents
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool, int, json.Number:
+		return true
+	}
+	return false
+}
+
+// compareFloat returns a comparator of numbers with the number. Strings are never
+// equal to or ordered with numbers.
+func compareFloat(operator Token, literal float64) func(interface{}) (bool, bool) {
+	return func(value interface{}) (bool, bool) {
+		if f, isNumber := floatFromValue(value); isNumber {
+			return operatorHolds(operator, f < literal, f == literal)
+		}
+		if _, isString := value.(string); isString {
+			return false, true
+		}
+		return false, false
+	}
+}
+
+// compareString returns a comparator of strings with the string. Numbers are never
+// equal to or ordered with strings.
+func compareString(operator Token, literal string) func(interface{}) (bool, bool) {
+	return func(value interface{}) (bool, bool) {
+		if _, isNumber := floatFromValue(value); isNumber {
+			return false, true
+		}
+		if s, isString := value.(string); isString {
+			return operatorHolds(operator, s < literal, s == literal)
+		}
+		return false, false
+	}
+}
+
+// operatorHolds tells whether the comparison holds given whether the lhs is less than and
+// equal to the rhs, the same way the comparison functions of the template package
+// derive the operators from lt and eq
+func operatorHolds(operator Token, less, equal bool) (result, ok bool) {
+	switch operator {
+	case LT:
+		return less, true
+	case LTE:
+		return less || equal, true
+	case GT:
+		return !(less || equal), true
+	case GTE:
+		return !less, true
+	case Equals:
+		return equal, true
+	case NEQ:
+		return !equal, true
+	}
+	return false, false
+}
@@ -0,0 +1,230 @@
+package jsonmatch
+
+import "encoding/json"
+
+// QuerySet matches several expressions against a document together. The paths of
+// the expressions are merged into a trie, so a prefix shared by several of them,
+// as `content..` in `content..[_type == "image"]` and `content..[_type == "link"]`,
+// is evaluated once per document, and only the rest of each expression is
+// evaluated on its own. A QuerySet may be used from several goroutines at once.
+type QuerySet struct {
+	exprs []*Expression
+	root  *queryNode
+}
+
+// queryNode is a node of the trie of a QuerySet. The expressions sharing the path
+// from the root of the trie down to the node share the evaluation of it.
+type queryNode struct {
+	// Evaluates the node of the path, nil for the root of the trie
+	step step
+	// Whether the node follows a recursive descent, see processPath
+	afterRecursive bool
+	// The nodes of the paths continuing from this one, in the order first seen
+	children []*queryNode
+	// The children by the key of their node, only used while building the trie
+	keys map[string]*queryNode
+	// The index of the expressions ending with this node
+	exprs []int
+}
+
+// NewQuerySet returns a QuerySet matching the expressions
+func NewQuerySet(exprs ...*Expression) *QuerySet {
+	qs := &QuerySet{exprs: exprs, root: &queryNode{}}
+	for i, expr := range exprs {
+		current := qs.root
+		nodes := []node{expr.root}
+		if path, ok := expr.root.(*pathNode); ok {
+			nodes = path.nodes
+		}
+		for j, n := range nodes {
+			afterRecursive := false
+			if j > 0 {
+				_, afterRecursive = nodes[j-1].(*recursiveNode)
+			}
+			current = current.child(n, afterRecursive)
+		}
+		current.exprs = append(current.exprs, i)
+	}
+	qs.root.release()
+	return qs
+}
+
+// child returns the child of the trie node evaluating n, adding it if needed. Nodes
+// are told apart by their JSON, in which string literals keep their position, so
+// only filters written the same way are shared.
+func (q *queryNode) child(n node, afterRecursive bool) *queryNode {
+	key, err := json.Marshal(n)
+	if err == nil {
+		if existing, ok := q.keys[string(key)]; ok {
+			return existing
+		}
+	}
+	child := &queryNode{step: compile(n), afterRecursive: afterRecursive}
+	q.children = append(q.children, child)
+	if err == nil {
+		// Nodes that can not be described are never shared
+		if q.keys == nil {
+			q.keys = map[string]*queryNode{}
+		}
+		q.keys[string(key)] = child
+	}
+	return child
+}
+
+// release drops the keys of the trie once it is built
+func (q *queryNode) release() {
+	q.keys = nil
+	for _, child := range q.children {
+		child.release()
+	}
+}
+
+// Match matches every expression of the QuerySet against the data, and returns a
+// MatchSet for each, in the order of the expressions. Each MatchSet is the same as
+// one returned by Expression.Match, and is mutated independently of the others. If
+// any of the expressions fails, its error is returned.
+func (qs *QuerySet) Match(data interface{}) ([]*MatchSet, error) {
+	refs := make([]Ref, len(qs.exprs))
+	shared := newRootVar(data)
+	if err := qs.root.evaluate(shared, refs); err != nil {
+		return nil, err
+	}
+	result := make([]*MatchSet, len(refs))
+	for i, ref := range refs {
+		// The first MatchSet keeps the variables of the evaluation
+		root := shared
+		if i > 0 {
+			root = newRootVar(data)
+			ref = (&rebase{from: shared, to: root}).ref(ref)
+		}
+		result[i] = &MatchSet{
+			root: root,
+			ref:  ref,
+		}
+	}
+	return result, nil
+}
+
+// evaluate evaluates the trie node against the input, storing the result of every
+// expression ending at or below the node in refs
+func (q *queryNode) evaluate(input Ref, refs []Ref) error {
+	result := input
+	if q.step != nil {
+		var err error
+		result, err = q.step(input)
+		if err != nil {
+			return err
+		}
+		if q.afterRecursive {
+			// Never offer to create missing values in every container of the document
+			result = withoutLatentRefs(result)
+		}
+	}
+	for _, i := range q.exprs {
+		refs[i] = result
+	}
+	for _, child := range q.children {
+		if err := child.evaluate(result, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebase moves refs from one root variable to another holding the same document,
+// so MatchSets evaluated together get variables of their own. Refs are never
+// modified, but the variables record the mutations made through them.
+type rebase struct {
+	from *VarRef
+	to   *VarRef
+	// The variable last moved at each depth, so the refs of a union, which are
+	// sorted by path, mostly share the variables moved for their parents
+	moved []movedVar
+	// Allocated in blocks, as the refs of a MatchSet are discarded together
+	vars   []VarRef
+	maps   []MapRef
+	arrays []ArrayRef
+}
+
+type movedVar struct {
+	from *VarRef
+	to   *VarRef
+}
+
+// ref returns the ref moved to the new root
+func (b *rebase) ref(ref Ref) Ref {
+	switch t := ref.(type) {
+	case *ArrayRef:
+		if len(b.arrays) == 0 {
+			b.arrays = make([]ArrayRef, 1)
+		}
+		moved := &b.arrays[0]
+		b.arrays = b.arrays[1:]
+		*moved = ArrayRef{variable: b.variable(t.variable), selection: t.selection}
+		return moved
+	case *MapRef:
+		if len(b.maps) == 0 {
+			b.maps = make([]MapRef, 1)
+		}
+		moved := &b.maps[0]
+		b.maps = b.maps[1:]
+		*moved = MapRef{variable: b.variable(t.variable), keys: t.keys}
+		return moved
+	case *VarRef:
+		// The root itself, as matched by `..` or `@`
+		return b.variable(t)
+	case *LatentMapRef:
+		return &LatentMapRef{root: b.ref(t.root), path: t.path}
+	case *UnionRef:
+		b.reserve(t.refs)
+		refs := make([]Ref, len(t.refs))
+		for i, r := range t.refs {
+			refs[i] = b.ref(r)
+		}
+		// Already merged and sorted, which moving them does not change
+		return &UnionRef{refs: refs}
+	}
+	return ref
+}
+
+// reserve allocates the refs needed to move the refs of a union
+func (b *rebase) reserve(refs []Ref) {
+	maps, arrays := 0, 0
+	for _, r := range refs {
+		switch r.(type) {
+		case *MapRef:
+			maps++
+		case *ArrayRef:
+			arrays++
+		}
+	}
+	b.maps = make([]MapRef, maps)
+	b.arrays = make([]ArrayRef, arrays)
+	// At least one variable per ref, more where their parents differ
+	b.vars = make([]VarRef, 0, len(refs))
+}
+
+// variable returns the variable moved to the new root
+func (b *rebase) variable(v *VarRef) *VarRef {
+	if v == b.from {
+		return b.to
+	}
+	if v.parent == nil {
+		// Not part of the document
+		return v
+	}
+	for len(b.moved) <= v.depth {
+		b.moved = append(b.moved, movedVar{})
+	}
+	if last := b.moved[v.depth]; last.from == v {
+		return last.to
+	}
+	if len(b.vars) == cap(b.vars) {
+		b.vars = make([]VarRef, 0, cap(b.vars)+1)
+	}
+	b.vars = append(b.vars, *v)
+	moved := &b.vars[len(b.vars)-1]
+	moved.parent = b.variable(v.parent)
+	b.moved[v.depth] = movedVar{from: v, to: moved}
+	return moved
+}
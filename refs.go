@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 // MutatorFunc is the signature for the callbacks provided to the Ref.Mutate methods
 type MutatorFunc func(path string, value interface{}) (interface{}, error)
 
+// errUnchanged is returned by internal mutators to leave the value as it is
+var errUnchanged = errors.New("Value left unchanged")
+
 // MutateRegionsFunc is the signature for the callbacks provided to the ArrayRef.MutateAll
 // methods that allow a selection of an array to be mutated as a whole. The selection is
 // provided as an array of arrays (since selections might not be contiguous). Each sub-array
@@ -83,25 +87,40 @@ type LiteralRef struct {
 // }
 
 // VarSetter is the signature for VarRef setters
-type VarSetter func(value interface{})
+type VarSetter func(value interface{}) error
 
 // VarGetter is the signature for VarRef getters
 type VarGetter func() interface{}
 
 // VarRef is a reference to a variable with the capacity to replace
-// the contents of said variable
+// the contents of said variable. The variables of maps and arrays are handles made
+// of the container and the key, and access the container when used.
 type VarRef struct {
-	// Method for setting the variable
+	// Method for setting the variable, only set on variables not held by a container
 	setter VarSetter
-	// Method for getting the current value
+	// Method for getting the current value, only set on variables not held by a container
 	getter VarGetter
 	// Scalar value indicating at what nesting depth the variable is from relative to root
 	depth int
 	// A unique name identifying the variable in the structure, in reality a jsonmatch string
-	// locating exactly this value
+	// locating exactly this value. Worked out from the parent when first needed, see id.
 	identity string
-	// The key of this value in the event that this is a variable from an array or map
-	key interface{}
+	// The key of this value in the event that this is a variable from a map
+	name string
+	// The index of this value in the event that this is a variable from an array
+	index int
+	// Whether the variable is a member of a map rather than an item of an array
+	inMap bool
+	// The variable of the array or map holding this value, nil for the root
+	parent *VarRef
+	// Receives the changes made to the document when recording. Only set on the root
+	journal *journal
+	// Notified of every container rewritten in the document. Only set on the root
+	observer *observer
+	// The containers created by the mutation in progress. Only set on the root
+	owner *ownership
+	// The limits of the match in progress, if any
+	evaluation *evaluation
 }
 
 // LatentMapRef is a reference to a keypath in a map that do not exist yet
@@ -109,12 +128,61 @@ type VarRef struct {
 // the void map ref will refer to `a.b` as the root, (since b is a key)
 // in a map that exists, but `c` has nowhere to go so a void map ref
 // is formed in case the client wants to set that value. In that case
-// the necessary maps will be created to realize the path. Every root
-// ref in a VoidMapRef must be a MapRef. The LatentMapRef will report
+// the necessary maps will be created to realize the path. The path may
+// also pass through array indicies (`a.b[0].c`) and keyed items
+// (`a.b[_key=="x"].c`) in which case arrays with a single item are created.
+// Every root ref in a LatentMapRef must be a MapRef, or an ArrayRef selecting
+// the empty region where a new item is to be inserted. The LatentMapRef will report
 // referring to absolutely no values, so cannot be mutated, only Set.
 type LatentMapRef struct {
-	root    Ref
-	keyPath []string
+	root Ref
+	path []latentSegment
+}
+
+// latentSegmentKind tells what kind of container a latent path segment is realized as
+type latentSegmentKind int
+
+const (
+	// A key in a map
+	latentKey latentSegmentKind = iota
+	// The first or last index of an array, both being the same in a new array
+	latentIndex
+	// An array item identified by the value of one of its fields, as in `[_key == "x"]`
+	latentKeyedItem
+)
+
+// latentSegment is one step in the path of a LatentMapRef
+type latentSegment struct {
+	kind latentSegmentKind
+	// The map key, or the identifying field of a keyed item
+	key string
+	// The key of a keyed item
+	value string
+}
+
+// cloneRef returns a copy of the ref that is unaffected by mutations through the
+// original. The underlying variables are shared.
+func cloneRef(ref Ref) Ref {
+	switch t := ref.(type) {
+	case *ArrayRef:
+		clone := *t
+		return &clone
+	case *MapRef:
+		clone := *t
+		return &clone
+	case *LatentMapRef:
+		// Realizing the path mutates the selection of its root
+		path := make([]latentSegment, len(t.path))
+		copy(path, t.path)
+		return &LatentMapRef{root: cloneRef(t.root), path: path}
+	case *UnionRef:
+		refs := make([]Ref, len(t.refs))
+		for i, r := range t.refs {
+			refs[i] = cloneRef(r)
+		}
+		return &UnionRef{refs: refs}
+	}
+	return ref
 }
 
 // Unwraps a ref into an array of refs
@@ -148,6 +216,81 @@ func latentMapRefs(ref Ref) []*LatentMapRef {
 	return result
 }
 
+// withoutLatentRefs removes any latent refs from the provided ref
+func withoutLatentRefs(ref Ref) Ref {
+	refs := individualRefs(ref)
+	result := make([]Ref, 0, len(refs))
+	for _, r := range refs {
+		if _, isLatent := r.(*LatentMapRef); !isLatent {
+			result = append(result, r)
+		}
+	}
+	if len(result) == len(refs) {
+		return ref
+	}
+	return NewUnionRef(result...)
+}
+
+// isAddressable is true if setting the ref would write at least one value
+func isAddressable(ref Ref) bool {
+	for _, r := range individualRefs(ref) {
+		if _, isLatent := r.(*LatentMapRef); isLatent || !r.IsEmpty() {
+			return true
+		}
+	}
+	return false
+}
+
+// setIfMissing sets the value of every referenced variable that is missing or nil,
+// and realizes any latent paths that do not collide with existing values.
+func setIfMissing(ref Ref, value interface{}) error {
+	for _, r := range individualRefs(ref) {
+		var err error
+		switch t := r.(type) {
+		case *LatentMapRef:
+			err = t.SetIfMissing(value)
+		case *MapRef:
+			var current map[string]interface{}
+			if current, err = t.variable.canonicalMap(); err != nil {
+				return err
+			}
+			missingKeys := make([]string, 0, len(t.keys))
+			for _, key := range t.keys {
+				if current[key] == nil {
+					missingKeys = append(missingKeys, key)
+				}
+			}
+			if len(missingKeys) > 0 {
+				err = newMapRef(t.variable, missingKeys).Set(value)
+			}
+		case *ArrayRef:
+			var current []interface{}
+			if current, err = t.variable.canonicalSlice(); err != nil {
+				return err
+			}
+			missing := make([]int, 0, t.EstimateSize())
+			for _, index := range t.selection.ToIndicies() {
+				if index < len(current) && current[index] == nil {
+					missing = append(missing, index)
+				}
+			}
+			if len(missing) > 0 {
+				err = newArrayRef(t.variable, NewRegionForEachIndex(missing)).Set(value)
+			}
+		case *VarRef:
+			if t.Value() == nil {
+				err = t.Set(value)
+			}
+		default:
+			err = fmt.Errorf("Cannot set value of a %T ref", r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewEmptyRef returns an empty Ref
 func NewEmptyRef() Ref {
 	return &UnionRef{[]Ref{}}
@@ -156,7 +299,7 @@ func NewEmptyRef() Ref {
 // GetLatentMapRef generates a latent map ref for any keys that are missing
 // or not Maps in the underlying value. If no such values, nil is returned
 func (r *MapRef) GetLatentMapRef() *LatentMapRef {
-	if value := r.variable.CanonicalValue().(map[string]interface{}); value != nil {
+	if value, _ := r.variable.canonicalMap(); value != nil {
 		var missingKeys []string
 		for _, key := range r.keys {
 			content, keyPresent := value[key]
@@ -165,17 +308,23 @@ func (r *MapRef) GetLatentMapRef() *LatentMapRef {
 			}
 		}
 		if len(missingKeys) > 0 {
-			return NewLatentMapRef(NewMapRef(r.variable, missingKeys), []string{})
+			return NewLatentMapRef(newMapRef(r.variable, missingKeys), []string{})
 		}
 	}
 	return nil
 }
 
-// NewArrayRef creates a new ArrayRef
-func NewArrayRef(variable *VarRef, selection Regions) *ArrayRef {
-	if _, ok := variable.CanonicalValue().([]interface{}); !ok {
-		panic("Variables wrapped by ArrayRefs must be compatible with type []interface{}")
+// NewArrayRef creates a new ArrayRef. An error is returned if the variable does
+// not hold a value compatible with []interface{}.
+func NewArrayRef(variable *VarRef, selection Regions) (*ArrayRef, error) {
+	if _, err := variable.canonicalSlice(); err != nil {
+		return nil, err
 	}
+	return newArrayRef(variable, selection), nil
+}
+
+// newArrayRef creates a new ArrayRef for a variable known to hold a slice
+func newArrayRef(variable *VarRef, selection Regions) *ArrayRef {
 	return &ArrayRef{
 		variable:  variable,
 		selection: selection,
@@ -185,10 +334,12 @@ func NewArrayRef(variable *VarRef, selection Regions) *ArrayRef {
 // Values implements the Values method
 func (r *ArrayRef) Values() []interface{} {
 	indicies := r.selection.ToIndicies()
-	result := make([]interface{}, len(indicies))
-	array := r.variable.CanonicalValue().([]interface{})
-	for i := range indicies {
-		result[i] = array[indicies[i]]
+	result := make([]interface{}, 0, len(indicies))
+	array, _ := r.variable.canonicalSlice()
+	for _, index := range indicies {
+		if index < len(array) {
+			result = append(result, array[index])
+		}
 	}
 	return result
 }
@@ -197,31 +348,17 @@ func (r *ArrayRef) Values() []interface{} {
 func (r *ArrayRef) Vars() []*VarRef {
 	indicies := r.selection.ToIndicies()
 	result := make([]*VarRef, len(indicies))
-	for i := range indicies {
-		index := indicies[i]
-		identity := fmt.Sprintf("%s[%06d]", r.variable.identity, index)
-		getter := func() interface{} {
-			return r.variable.CanonicalValue().([]interface{})[index]
-		}
-		setter := func(value interface{}) { // Setter
-			// Clone the array, insert the new value and update the
-			// value of our array
-			current := r.variable.CanonicalValue().([]interface{})
-			mutated := make([]interface{}, len(current))
-			copy(mutated, current)
-			mutated[index] = value
-			if err := r.variable.Set(mutated); err != nil {
-				// FIXME: Return error
-				panic(err)
-			}
-		}
-		result[i] = &VarRef{
-			identity: identity,
-			setter:   setter,
-			getter:   getter,
-			depth:    r.Depth() + 1,
-			key:      i,
+	// Allocated together, as they are usually discarded together
+	vars := make([]VarRef, len(indicies))
+	for i, index := range indicies {
+		vars[i] = VarRef{
+			depth:  r.Depth() + 1,
+			index:  index,
+			parent: r.variable,
+			// Inherited, so every variable of a match can check its limits
+			evaluation: r.variable.evaluation,
 		}
+		result[i] = &vars[i]
 	}
 	return result
 }
@@ -233,7 +370,10 @@ func (r *ArrayRef) indexIncluded(index int) bool {
 
 // Delete implements the Ref.Delete method
 func (r *ArrayRef) Delete() error {
-	current := r.variable.CanonicalValue().([]interface{})
+	current, err := r.variable.canonicalSlice()
+	if err != nil {
+		return err
+	}
 	regionsToKeep := Regions{Region{0, len(current)}}.Intersect(r.selection)
 	capacity := regionsToKeep.IndiciesCount()
 	modified := make([]interface{}, 0, capacity)
@@ -242,9 +382,22 @@ func (r *ArrayRef) Delete() error {
 			modified = append(modified, current[i])
 		}
 	}
+	if r.variable.recording() {
+		deleted := r.selection.clip(len(current))
+		_, restoreAt := deleted.MergeItems(current, nil)
+		r.variable.record(change{
+			kind:     changeSplice,
+			path:     r.variable.path(),
+			replaced: deleted,
+			regions:  restoreAt,
+			removed:  deleted.ExtractItems(current),
+			inserted: make([][]interface{}, len(restoreAt)),
+		})
+	}
 	// Replace the value with the subset effectively deleting the indicies pointed to
 	// by this ref
-	if err := r.variable.SetWithMatchedType(modified); err != nil {
+	r.variable.own(modified)
+	if err := r.variable.writeWithMatchedType(modified); err != nil {
 		return err
 	}
 	// Clear indicies set since they are now gone from the underlying set
@@ -254,21 +407,30 @@ func (r *ArrayRef) Delete() error {
 
 // Mutate implements the Ref.Mutate method
 func (r *ArrayRef) Mutate(mutator MutatorFunc) error {
-	current := r.variable.CanonicalValue().([]interface{})
-	modified := make([]interface{}, len(current))
-	copy(modified, current)
+	modified, fresh, err := r.variable.mutableSlice()
+	if err != nil {
+		return err
+	}
 	for _, region := range r.selection {
-		for i := region.Start; i < region.End; i++ {
+		for i := region.Start; i < region.End && i < len(modified); i++ {
 			if r.indexIncluded(i) {
-				newValue, err := mutator(fmt.Sprintf("%s[%06d]", r.variable.identity, i), current[i])
+				current := modified[i]
+				newValue, err := mutator(fmt.Sprintf("%s[%06d]", r.variable.id(), i), current)
+				if err == errUnchanged {
+					continue
+				}
 				if err != nil {
 					return err
 				}
+				if err := assertIsCompatible(newValue); err != nil {
+					return err
+				}
 				modified[i] = newValue
+				r.variable.recordMember(i, true, current, newValue)
 			}
 		}
 	}
-	return r.variable.SetWithMatchedType(modified)
+	return r.variable.commit(modified, fresh)
 }
 
 // MutateRegions lets you mutate the parts of an array as a whole. The mutator
@@ -279,15 +441,34 @@ func (r *ArrayRef) Mutate(mutator MutatorFunc) error {
 // of the ArrayRef are updated to reflect the new positions so this method may be
 // combined with other mutations afterwards.
 func (r *ArrayRef) MutateRegions(mutator MutateRegionsFunc) error {
-	original := r.variable.CanonicalValue().([]interface{})
+	original, err := r.variable.canonicalSlice()
+	if err != nil {
+		return err
+	}
 	extract := r.selection.ExtractItems(original)
+	var removed [][]interface{}
+	if r.variable.recording() {
+		// The mutator may modify the extract in place, so keep our own copy
+		removed = r.selection.ExtractItems(original)
+	}
 	modifiedExtract, err := mutator(
-		fmt.Sprintf("%s[%s]", r.variable.identity, r.selection.ToSliceSelector()), extract)
+		fmt.Sprintf("%s[%s]", r.variable.id(), r.selection.ToSliceSelector()), extract)
 	if err != nil {
 		return err
 	}
 	modified, updatedRegions := r.selection.MergeItems(original, modifiedExtract)
-	if e := r.variable.SetWithMatchedType(modified); e != nil {
+	if r.variable.recording() {
+		r.variable.record(change{
+			kind:     changeSplice,
+			path:     r.variable.path(),
+			replaced: r.selection,
+			regions:  updatedRegions,
+			removed:  removed,
+			inserted: updatedRegions.ExtractItems(modified),
+		})
+	}
+	r.variable.own(modified)
+	if e := r.variable.writeWithMatchedType(modified); e != nil {
 		return e
 	}
 
@@ -299,15 +480,20 @@ func (r *ArrayRef) MutateRegions(mutator MutateRegionsFunc) error {
 
 // Set implements the Ref.Set method
 func (r *ArrayRef) Set(value interface{}) error {
-	current := r.variable.CanonicalValue().([]interface{})
-	modified := make([]interface{}, len(current))
-	copy(modified, current)
-	for i := 0; i < len(current); i++ {
-		if r.indexIncluded(i) {
+	if err := assertIsCompatible(value); err != nil {
+		return err
+	}
+	modified, fresh, err := r.variable.mutableSlice()
+	if err != nil {
+		return err
+	}
+	for _, region := range r.selection.clip(len(modified)) {
+		for i := region.Start; i < region.End; i++ {
+			r.variable.recordMember(i, true, modified[i], value)
 			modified[i] = value
 		}
 	}
-	return r.variable.SetWithMatchedType(modified)
+	return r.variable.commit(modified, fresh)
 }
 
 // Depth implements the Ref.Depth method
@@ -328,7 +514,7 @@ func (r *ArrayRef) EstimateSize() int {
 // Merge implements Ref.Merge
 func (r *ArrayRef) Merge(ref Ref) (Ref, bool) {
 	if other, ok := ref.(*ArrayRef); ok {
-		if r.variable.identity == other.variable.identity {
+		if r.variable.id() == other.variable.id() {
 			// Can be merged!
 			return &ArrayRef{
 				variable:  r.variable,
@@ -345,11 +531,17 @@ func (r *ArrayRef) Union(refs ...Ref) Ref {
 	return NewUnionRef(append(refs, r)...)
 }
 
-// NewMapRef creates a new MapRef
-func NewMapRef(variable *VarRef, keys []string) *MapRef {
-	if _, ok := variable.CanonicalValue().(map[string]interface{}); !ok {
-		panic("Variables wrapped by MapRefs must be of type map[string]interface{}")
+// NewMapRef creates a new MapRef. An error is returned if the variable does not
+// hold a value compatible with map[string]interface{}.
+func NewMapRef(variable *VarRef, keys []string) (*MapRef, error) {
+	if _, err := variable.canonicalMap(); err != nil {
+		return nil, err
 	}
+	return newMapRef(variable, keys), nil
+}
+
+// newMapRef creates a new MapRef for a variable known to hold a map
+func newMapRef(variable *VarRef, keys []string) *MapRef {
 	sort.Strings(keys)
 	return &MapRef{
 		variable: variable,
@@ -359,7 +551,7 @@ func NewMapRef(variable *VarRef, keys []string) *MapRef {
 
 // Values implements the Ref.Values method
 func (r *MapRef) Values() []interface{} {
-	current := r.variable.CanonicalValue().(map[string]interface{})
+	current, _ := r.variable.canonicalMap()
 	result := make([]interface{}, 0, len(r.keys))
 	for i := range r.keys {
 		val := current[r.keys[i]]
@@ -370,74 +562,126 @@ func (r *MapRef) Values() []interface{} {
 	return result
 }
 
-func (r *MapRef) cloneMap() map[string]interface{} {
-	result := make(map[string]interface{})
-	current := r.variable.CanonicalValue().(map[string]interface{})
-	for k, v := range current {
-		result[k] = v
-	}
-	return result
-}
-
 // Vars returns VarRefs for all the referenced variable
 func (r *MapRef) Vars() []*VarRef {
 	result := make([]*VarRef, len(r.keys))
-	for i := range r.keys {
-		key := r.keys[i]
-		identity := fmt.Sprintf("%s.%s", r.variable.identity, key)
-		getter := func() interface{} { // getter
-			return r.variable.CanonicalValue().(map[string]interface{})[key]
-		}
-		setter := func(value interface{}) { // setter
-			// Make a shallow copy of the contained map, then replace the value
-			modified := r.cloneMap()
-			modified[key] = value
-			if err := r.variable.Set(modified); err != nil {
-				// FIXME: Return error
-				panic(err)
-			}
-		}
-		result[i] = &VarRef{
-			identity: identity,
-			setter:   setter,
-			getter:   getter,
-			depth:    r.Depth() + 1,
-			key:      key,
+	// Allocated together, as they are usually discarded together
+	vars := make([]VarRef, len(r.keys))
+	for i, key := range r.keys {
+		vars[i] = VarRef{
+			depth:  r.Depth() + 1,
+			name:   key,
+			inMap:  true,
+			parent: r.variable,
+			// Inherited, so every variable of a match can check its limits
+			evaluation: r.variable.evaluation,
 		}
+		result[i] = &vars[i]
 	}
 	return result
 }
 
 // Mutate implements the Ref.Mutate method
 func (r *MapRef) Mutate(mutator MutatorFunc) error {
-	current := r.variable.CanonicalValue().(map[string]interface{})
-	modified := r.cloneMap()
+	modified, fresh, err := r.variable.mutableMap()
+	if err != nil {
+		return err
+	}
 	for _, key := range r.keys {
-		newValue, err := mutator(fmt.Sprintf("%s.%s", r.variable.identity, key), current[key])
+		newValue, err := mutator(fmt.Sprintf("%s.%s", r.variable.id(), key), modified[key])
+		if err == errUnchanged {
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		if err := assertIsCompatible(newValue); err != nil {
+			return err
+		}
+		before, existed := modified[key]
 		modified[key] = newValue
+		r.variable.recordMember(key, existed, before, newValue)
 	}
-	return r.variable.SetWithMatchedType(modified)
+	return r.variable.commit(modified, fresh)
 }
 
 // Set implements the Ref.Set method
 func (r *MapRef) Set(value interface{}) error {
-	modified := r.cloneMap()
+	if err := assertIsCompatible(value); err != nil {
+		return err
+	}
+	modified, fresh, err := r.variable.mutableMap()
+	if err != nil {
+		return err
+	}
 	for _, key := range r.keys {
+		before, existed := modified[key]
 		modified[key] = value
+		r.variable.recordMember(key, existed, before, value)
 	}
-	return r.variable.SetWithMatchedType(modified)
+	return r.variable.commit(modified, fresh)
 }
 
 // Delete implements the Ref.Delete method
 func (r *MapRef) Delete() error {
-	modified := r.cloneMap()
+	modified, fresh, err := r.variable.mutableMap()
+	if err != nil {
+		return err
+	}
+	for _, key := range r.keys {
+		if before, existed := modified[key]; existed {
+			delete(modified, key)
+			r.variable.recordDeletedMember(key, before)
+		}
+	}
+	return r.variable.commit(modified, fresh)
+}
+
+// renamableKey returns the key that would be renamed by Rename, or the empty
+// string if none of the referenced keys are present in the map.
+func (r *MapRef) renamableKey(newName string) (string, error) {
+	current, err := r.variable.canonicalMap()
+	if err != nil {
+		return "", err
+	}
+	found := ""
 	for _, key := range r.keys {
-		delete(modified, key)
+		if _, present := current[key]; !present || key == newName {
+			continue
+		}
+		if found != "" {
+			return "", fmt.Errorf("Cannot rename both %s.%s and %s.%s to %q", r.variable.id(), found, r.variable.id(), key, newName)
+		}
+		found = key
+	}
+	if _, exists := current[newName]; found != "" && exists {
+		return "", fmt.Errorf("Cannot rename %s.%s to %q, the key allready exists", r.variable.id(), found, newName)
+	}
+	return found, nil
+}
+
+// Rename moves the value of the referenced key to the key newName in the underlying
+// map. Keys that are not present are ignored, but an error is returned if more than
+// one referenced key is present, or newName is allready in use. The MapRef is updated
+// to refer to the new key.
+func (r *MapRef) Rename(newName string) error {
+	key, err := r.renamableKey(newName)
+	if err != nil || key == "" {
+		return err
+	}
+	modified, fresh, err := r.variable.mutableMap()
+	if err != nil {
+		return err
+	}
+	modified[newName] = modified[key]
+	delete(modified, key)
+	r.variable.recordDeletedMember(key, modified[newName])
+	r.variable.recordMember(newName, false, nil, modified[newName])
+	if err := r.variable.commit(modified, fresh); err != nil {
+		return err
 	}
-	return r.variable.SetWithMatchedType(modified)
+	r.keys = []string{newName}
+	return nil
 }
 
 // Depth implements the Ref.Depth method
@@ -458,7 +702,7 @@ func (r *MapRef) IsEmpty() bool {
 // Merge implements Ref.Merge
 func (r *MapRef) Merge(ref Ref) (Ref, bool) {
 	if other, ok := ref.(*MapRef); ok {
-		if other.variable.identity == r.variable.identity {
+		if other.variable.id() == r.variable.id() {
 			// Can be merged!
 			return &MapRef{
 				variable: r.variable,
@@ -557,39 +801,185 @@ func (r *UnionRef) Vars() []*VarRef {
 	return result
 }
 
-// Union implements the Ref.Union method
+// Union implements the Ref.Union method. Refs to the same underlying variable are
+// joined into one ref selecting the union of their selections.
 func (r *UnionRef) Union(refs ...Ref) Ref {
-	// TODO: If two underlying refs are referencing the same base object, join them
-	// by substituting both with one ref where the selection is the union of the two
-	var result Ref = r
+	if len(r.refs) == 0 && len(refs) == 1 {
+		if _, isUnion := refs[0].(*UnionRef); !isUnion {
+			return refs[0]
+		}
+	}
+	var members unionMembers
+	members.add(r.refs)
+	members.add(refs)
+	result := members.union()
+	// Unwrap unions with only one member, no reason to keep the UnionRef wrapper
+	if len(result.refs) == 1 {
+		return result.refs[0]
+	}
+	return result
+}
+
+// mergeKey identifies the refs that Merge joins with each other
+type mergeKey struct {
+	kind string
+	// The identity of the variable referenced
+	identity string
+	// The value of literals, or the ref itself for refs that only merge with themselves
+	value interface{}
+}
+
+// mergeKeyOf returns the key of the refs that the ref merges with. Refs of types
+// unknown to the package have none, and are merged by calling Merge.
+func mergeKeyOf(ref Ref) (mergeKey, bool) {
+	switch t := ref.(type) {
+	case *ArrayRef:
+		return mergeKey{kind: "array", identity: t.variable.id()}, true
+	case *MapRef:
+		return mergeKey{kind: "map", identity: t.variable.id()}, true
+	case *VarRef:
+		return mergeKey{kind: "var", identity: t.id()}, true
+	case *LiteralRef:
+		if t.value == nil || reflect.TypeOf(t.value).Comparable() {
+			return mergeKey{kind: "literal", value: t.value}, true
+		}
+	case *LatentMapRef:
+		return mergeKey{kind: "latent", value: t}, true
+	}
+	return mergeKey{}, false
+}
+
+// unionMembers collects the members of a union, grouping the refs to the same
+// underlying variable so that each group is merged once when the union is made,
+// rather than merging and sorting the union again for every ref added.
+type unionMembers struct {
+	// The first ref of each group, in the order they were added
+	refs []Ref
+	// The refs to merge with the first ref of each group
+	merges [][]Ref
+	// The merge key of each group, the zero key for refs without one
+	keys []mergeKey
+	// The group of each key, only made once there are enough groups to need it
+	groups map[mergeKey]int
+	// Whether there are refs without a key, which must be merged one by one
+	unkeyed bool
+}
+
+// How many groups a union may have before they are looked up by key in a map
+const unionGroupsScanned = 8
+
+// add adds the refs to the union, unwrapping any unions among them
+func (m *unionMembers) add(refs []Ref) {
 	for _, ref := range refs {
-		switch t := ref.(type) {
-		case *UnionRef:
-			// Unwrap secondary unions in order to avoid recursion
-			result = result.Union(t.refs...)
-		default:
-			// First see if this can be merged into an existing ref
-			if merged, didMerge := result.Merge(ref); didMerge {
-				result = merged
-			} else {
-				// Resort to adding it to the end of the existing union, if no merge
-				// was possible
-				result = &UnionRef{refs: append(result.(*UnionRef).refs, ref)}
+		if union, ok := ref.(*UnionRef); ok {
+			m.add(union.refs)
+			continue
+		}
+		key, hasKey := mergeKeyOf(ref)
+		if !hasKey {
+			m.unkeyed = true
+			m.append(ref, mergeKey{})
+		} else if group, found := m.group(key); found {
+			m.merges[group] = append(m.merges[group], ref)
+		} else {
+			m.append(ref, key)
+		}
+	}
+}
+
+// group returns the group of refs with the key, if there is one
+func (m *unionMembers) group(key mergeKey) (int, bool) {
+	if m.groups != nil {
+		group, found := m.groups[key]
+		return group, found
+	}
+	for group, k := range m.keys {
+		if k == key {
+			return group, true
+		}
+	}
+	return 0, false
+}
+
+// append adds a new group starting with the ref
+func (m *unionMembers) append(ref Ref, key mergeKey) {
+	m.refs = append(m.refs, ref)
+	m.merges = append(m.merges, nil)
+	m.keys = append(m.keys, key)
+	if m.groups == nil && len(m.keys) > unionGroupsScanned {
+		m.groups = make(map[mergeKey]int, len(m.keys))
+		for group, k := range m.keys {
+			if k != (mergeKey{}) {
+				m.groups[k] = group
 			}
 		}
+	} else if m.groups != nil && key != (mergeKey{}) {
+		m.groups[key] = len(m.keys) - 1
 	}
+}
 
-	if union, ok := result.(*UnionRef); ok {
-		// Unwrap unions with only one member, no reason to keep the UnionRef wrapper
-		if len(union.refs) == 1 {
-			return union.refs[0]
+// union returns the union of the refs added, with the refs of each group merged
+// and sorted depth first
+func (m *unionMembers) union() *UnionRef {
+	result := make([]Ref, 0, len(m.refs))
+	for i, ref := range m.refs {
+		if len(m.merges[i]) > 0 {
+			ref = mergeAll(ref, m.merges[i])
 		}
-		// Call sort to make sure the union is sorted depth first at all times
-		sort.Sort(union)
-	} else {
-		panic("BUG: Result of a union with more than one member must be *UnionRef")
+		result = append(result, ref)
 	}
+	if m.unkeyed {
+		result = mergeUnkeyed(result)
+	}
+	union := &UnionRef{refs: result}
+	// Sort to make sure the union is sorted depth first at all times
+	sort.Stable(union)
+	return union
+}
+
+// mergeAll merges the refs into the first ref, which they all share a merge key with
+func mergeAll(first Ref, rest []Ref) Ref {
+	switch t := first.(type) {
+	case *ArrayRef:
+		selections := make([]Regions, 0, len(rest)+1)
+		selections = append(selections, t.selection)
+		for _, ref := range rest {
+			selections = append(selections, ref.(*ArrayRef).selection)
+		}
+		return &ArrayRef{
+			variable:  t.variable,
+			selection: unionRegions(selections),
+		}
+	case *MapRef:
+		keys := make([][]string, 0, len(rest)+1)
+		keys = append(keys, t.keys)
+		for _, ref := range rest {
+			keys = append(keys, ref.(*MapRef).keys)
+		}
+		return &MapRef{
+			variable: t.variable,
+			keys:     unionKeys(keys...),
+		}
+	}
+	// Other refs merge with the refs sharing their key by staying as they are
+	return first
+}
 
+// mergeUnkeyed merges the refs the way Merge does, one pair at a time
+func mergeUnkeyed(refs []Ref) []Ref {
+	result := make([]Ref, 0, len(refs))
+	for _, ref := range refs {
+		merged := false
+		for i, existing := range result {
+			if joined, ok := existing.Merge(ref); ok {
+				result[i], merged = joined, true
+				break
+			}
+		}
+		if !merged {
+			result = append(result, ref)
+		}
+	}
 	return result
 }
 
@@ -662,38 +1052,177 @@ func (r *VarRef) Set(value interface{}) error {
 	if err != nil {
 		return err
 	}
-	r.setter(value)
+	if r.recording() {
+		r.record(change{kind: changeSet, path: r.path(), existed: r.exists(), before: r.Value(), after: value})
+	}
+	return r.put(value)
+}
+
+// write sets the value of the variable without recording it as a change. Used when
+// refs rewrite the containers holding the values they change.
+func (r *VarRef) write(value interface{}) error {
+	err := assertIsCompatible(value)
+	if err != nil {
+		return err
+	}
+	o := r.root().observer
+	if o == nil {
+		return r.put(value)
+	}
+	oldValue := r.Value()
+	if err := r.put(value); err != nil {
+		return err
+	}
+	o.notify(r.path(), oldValue, value)
+	return nil
+}
+
+// writeWithMatchedType is to write what SetWithMatchedType is to Set
+func (r *VarRef) writeWithMatchedType(value interface{}) error {
+	return r.write(matchType(value, r.Value()))
+}
+
+// exists is false if the variable is a member of a map or array that does not
+// hold it at the moment
+func (r *VarRef) exists() bool {
+	if r.parent == nil {
+		return true
+	}
+	if r.inMap {
+		current, _ := r.parent.canonicalMap()
+		_, present := current[r.name]
+		return present
+	}
+	current, _ := r.parent.canonicalSlice()
+	return r.index < len(current)
+}
+
+// id returns the identity of the variable. The identities of members of maps and
+// arrays are worked out from the identity of the container the first time they are
+// needed, as most variables made by matching are never asked for it.
+func (r *VarRef) id() string {
+	if r.identity == "" && r.parent != nil {
+		parent := r.parent.id()
+		if r.inMap {
+			r.identity = parent + "." + r.name
+		} else {
+			// The same as formatting with "%s[%06d]"
+			var b strings.Builder
+			index := strconv.Itoa(r.index)
+			b.Grow(len(parent) + 8 + len(index))
+			b.WriteString(parent)
+			b.WriteByte('[')
+			for i := len(index); i < 6; i++ {
+				b.WriteByte('0')
+			}
+			b.WriteString(index)
+			b.WriteByte(']')
+			r.identity = b.String()
+		}
+	}
+	return r.identity
+}
+
+// get returns the current value of the variable
+func (r *VarRef) get() interface{} {
+	if r.parent == nil {
+		return r.getter()
+	}
+	// The container may have been replaced since the variable was made
+	if r.inMap {
+		current, _ := r.parent.canonicalMap()
+		return current[r.name]
+	}
+	if current, _ := r.parent.canonicalSlice(); r.index < len(current) {
+		return current[r.index]
+	}
 	return nil
 }
 
+// put replaces the value of the variable. Members of maps and arrays are replaced
+// in a copy of the container, unless this mutation allready made one.
+func (r *VarRef) put(value interface{}) error {
+	if r.parent == nil {
+		return r.setter(value)
+	}
+	if r.inMap {
+		modified, fresh, err := r.parent.mutableMap()
+		if err != nil {
+			return err
+		}
+		modified[r.name] = value
+		return r.parent.commit(modified, fresh)
+	}
+	modified, fresh, err := r.parent.mutableSlice()
+	if err != nil {
+		return err
+	}
+	if r.index >= len(modified) {
+		return fmt.Errorf("Cannot set %s, the array has changed", r.id())
+	}
+	modified[r.index] = value
+	return r.parent.commit(modified, fresh)
+}
+
 // SetWithMatchedType updates the value, but attempts to avoid changing
 // the underlying type if the new value is one of the canonical types
 func (r *VarRef) SetWithMatchedType(value interface{}) error {
 	return r.Set(matchType(value, r.Value()))
 }
 
-// CanonicalValue gets the current value of the variable converted to canonical type
-func (r *VarRef) CanonicalValue() interface{} {
-	canonical, _, err := toCanonicalType(r.getter())
+// CanonicalValue gets the current value of the variable converted to canonical type,
+// or an error if the value has no canonical type
+func (r *VarRef) CanonicalValue() (interface{}, error) {
+	canonical, _, err := toCanonicalType(r.get())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", r.id(), err)
+	}
+	return canonical, nil
+}
+
+// canonicalSlice gets the current value of the variable as a []interface{}, or an
+// error if the value is not compatible with that type
+func (r *VarRef) canonicalSlice() ([]interface{}, error) {
+	canonical, _, err := toCanonicalType(r.get())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", r.id(), err)
+	}
+	slice, ok := canonical.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be compatible with type []interface{}, but is %T", r.id(), canonical)
+	}
+	return slice, nil
+}
+
+// canonicalMap gets the current value of the variable as a map[string]interface{}, or
+// an error if the value is not compatible with that type
+func (r *VarRef) canonicalMap() (map[string]interface{}, error) {
+	canonical, _, err := toCanonicalType(r.get())
 	if err != nil {
-		panic(err) // TODO: Maybe not panic here
+		return nil, fmt.Errorf("%s: %s", r.id(), err)
 	}
-	return canonical
+	m, ok := canonical.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be compatible with type map[string]interface{}, but is %T", r.id(), canonical)
+	}
+	return m, nil
 }
 
 // Value gets the current value of the variable in original underlying type
 func (r *VarRef) Value() interface{} {
-	return r.getter()
+	return r.get()
 }
 
 // Mutate mutates
 func (r *VarRef) Mutate(mutator MutatorFunc) error {
-	newValue, err := mutator(r.identity, r.getter())
+	newValue, err := mutator(r.id(), r.get())
+	if err == errUnchanged {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	r.setter(newValue)
-	return nil
+	return r.Set(newValue)
 }
 
 // Delete is not supported for VarRefs
@@ -714,7 +1243,7 @@ func (r *VarRef) EstimateSize() int {
 // Merge only "merges" two identical VarRefs
 func (r *VarRef) Merge(ref Ref) (Ref, bool) {
 	if varRef, ok := ref.(*VarRef); ok {
-		if varRef.identity == r.identity {
+		if varRef.id() == r.id() {
 			return r, true
 		}
 	}
@@ -733,7 +1262,7 @@ func (r *VarRef) Depth() int {
 
 // TypeKind returns the kind of the type contained by the VarRef
 func (r *VarRef) TypeKind() reflect.Kind {
-	value := r.getter()
+	value := r.get()
 	if value == nil {
 		return reflect.Invalid
 	}
@@ -763,14 +1292,42 @@ func (r *VarRef) IsContainer() bool {
 	return false
 }
 
-// Index returns the int-index of this VarRef if it is originally from a slice
+// Index returns the int-index of this VarRef if it is originally from a slice. It
+// panics for any other variable, see IndexOk.
 func (r *VarRef) Index() int {
-	return r.key.(int)
+	index, ok := r.IndexOk()
+	if !ok {
+		panic(fmt.Sprintf("%s is not an item of an array", r.id()))
+	}
+	return index
+}
+
+// IndexOk returns the int-index of this VarRef if it is originally from a slice, and
+// whether it is
+func (r *VarRef) IndexOk() (int, bool) {
+	if r.parent == nil || r.inMap {
+		return 0, false
+	}
+	return r.index, true
 }
 
-// Key returns the key of this VarRef if it was originally from a map
+// Key returns the key of this VarRef if it was originally from a map. It panics for
+// any other variable, see KeyOk.
 func (r *VarRef) Key() string {
-	return r.key.(string)
+	key, ok := r.KeyOk()
+	if !ok {
+		panic(fmt.Sprintf("%s is not a member of a map", r.id()))
+	}
+	return key
+}
+
+// KeyOk returns the key of this VarRef if it was originally from a map, and whether
+// it was
+func (r *VarRef) KeyOk() (string, bool) {
+	if !r.inMap {
+		return "", false
+	}
+	return r.name, true
 }
 
 // NewLiteralRef returns a new *LiteralRef
@@ -788,26 +1345,25 @@ func (r *LiteralRef) Vars() []*VarRef {
 	getter := func() interface{} {
 		return r.value
 	}
-	setter := func(v interface{}) {
-		panic("Attempt to set value of LiteralRef")
+	setter := func(v interface{}) error {
+		return errors.New("Attempt to set value of LiteralRef")
 	}
 	return []*VarRef{NewVarRef("[literal]", getter, setter, -1)}
 }
 
-// Set sets the value of the contained variable
+// Set is not supported for LiteralRefs
 func (r *LiteralRef) Set(value interface{}) error {
-	panic("Attempt to set value of LiteralRef")
+	return errors.New("Attempt to set value of LiteralRef")
 }
 
-// SetWithMatchedType updates the value, but attempts to avoid changing
-// the underlying type if the new value is one of the canonical types
+// SetWithMatchedType is not supported for LiteralRefs
 func (r *LiteralRef) SetWithMatchedType(value interface{}) error {
-	panic("Attempt to set value of LiteralRef")
+	return errors.New("Attempt to set value of LiteralRef")
 }
 
 // CanonicalValue gets the current value of the variable converted to canonical type
-func (r *LiteralRef) CanonicalValue() interface{} {
-	return r.value
+func (r *LiteralRef) CanonicalValue() (interface{}, error) {
+	return r.value, nil
 }
 
 // Value gets the current value of the variable in original underlying type
@@ -815,14 +1371,14 @@ func (r *LiteralRef) Value() interface{} {
 	return r.value
 }
 
-// Mutate mutates
+// Mutate is not supported for LiteralRefs
 func (r *LiteralRef) Mutate(mutator MutatorFunc) error {
-	panic("Attempt to mutate value of LiteralRef")
+	return errors.New("Attempt to mutate value of LiteralRef")
 }
 
-// Delete is not supported for VarRefs
+// Delete is not supported for LiteralRefs
 func (r *LiteralRef) Delete() error {
-	panic("Attempt to delete LiteralRef")
+	return errors.New("Attempt to delete LiteralRef")
 }
 
 // IsEmpty is never true for VarRefs
@@ -857,7 +1413,112 @@ func (r *LiteralRef) Depth() int {
 
 // NewLatentMapRef returns a new *LatentMapRef
 func NewLatentMapRef(rootRef Ref, keyPath []string) *LatentMapRef {
-	return &LatentMapRef{rootRef, keyPath}
+	path := make([]latentSegment, 0, len(keyPath))
+	for _, key := range keyPath {
+		path = append(path, latentSegment{kind: latentKey, key: key})
+	}
+	return &LatentMapRef{rootRef, path}
+}
+
+// newLatentItemRef returns a *LatentMapRef that inserts a new item at the (empty)
+// region selected by arrayRef. The segment describes the item to be created.
+func newLatentItemRef(arrayRef *ArrayRef, segment latentSegment) *LatentMapRef {
+	return &LatentMapRef{arrayRef, []latentSegment{segment}}
+}
+
+// keyedItemSegment returns a latentKeyedItem segment for filters that identify array
+// items by a literal key, as in `[_key == "x"]`. Filters on any other field select
+// items by their content, and setting through them never creates anything.
+func keyedItemSegment(node *filterNode) (latentSegment, bool) {
+	if node.operator != Equals {
+		return latentSegment{}, false
+	}
+	lhs := node.lhs
+	if path, ok := lhs.(*pathNode); ok && len(path.nodes) == 2 {
+		if _, isSelf := path.nodes[0].(*selfNode); isSelf {
+			lhs = path.nodes[1]
+		}
+	}
+	field, ok := lhs.(*fieldNode)
+	if !ok || field.name != "_key" {
+		return latentSegment{}, false
+	}
+	rhs, ok := node.rhs.(*stringNode)
+	if !ok {
+		return latentSegment{}, false
+	}
+	return latentSegment{kind: latentKeyedItem, key: field.name, value: rhs.value}, true
+}
+
+// withSegment returns a copy of the LatentMapRef with the segment appended to its
+// path, or nil if there is no way to realize the segment. Array segments are never
+// realized in place of existing arrays, those are handled by regular ArrayRefs.
+func (r *LatentMapRef) withSegment(segment latentSegment) *LatentMapRef {
+	root := r.root
+	if len(r.path) == 0 && segment.kind != latentKey {
+		var roots []Ref
+		for _, ref := range individualRefs(r.root) {
+			mapRef, ok := ref.(*MapRef)
+			if !ok {
+				roots = append(roots, ref)
+				continue
+			}
+			current, _ := mapRef.variable.canonicalMap()
+			keys := make([]string, 0, len(mapRef.keys))
+			for _, key := range mapRef.keys {
+				if current[key] == nil || reflect.TypeOf(current[key]).Kind() != reflect.Slice {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) > 0 {
+				roots = append(roots, newMapRef(mapRef.variable, keys))
+			}
+		}
+		if len(roots) == 0 {
+			return nil
+		}
+		root = NewUnionRef(roots...)
+	}
+	if len(r.path) > 0 && r.path[len(r.path)-1].kind == latentKeyedItem && segment.kind != latentKey {
+		// A keyed item must be a map to hold its key
+		return nil
+	}
+	path := make([]latentSegment, len(r.path), len(r.path)+1)
+	copy(path, r.path)
+	return &LatentMapRef{root, append(path, segment)}
+}
+
+// node returns a node matching the value created for the segment
+func (s latentSegment) node() node {
+	switch s.kind {
+	case latentIndex:
+		return &indexNode{value: 0, sealed: true}
+	case latentKeyedItem:
+		return &filterNode{lhs: &fieldNode{name: s.key}, operator: Equals, rhs: &stringNode{value: s.value}}
+	}
+	return &existingFieldNode{name: s.key}
+}
+
+// resolve returns a ref to the values created by setting the LatentMapRef
+func (r *LatentMapRef) resolve() (Ref, error) {
+	nodes := make([]node, 0, len(r.path))
+	for _, segment := range r.path {
+		nodes = append(nodes, segment.node())
+	}
+	result := NewEmptyRef()
+	for _, ref := range individualRefs(r.root) {
+		path := &pathNode{nodes: nodes}
+		if _, ok := ref.(*ArrayRef); ok {
+			// The selection of the root covers the created item itself
+			path = &pathNode{nodes: nodes[1:]}
+		}
+		resolved, err := processPath(ref, path)
+		if err != nil {
+			return nil, err
+		}
+		result = result.Union(withoutLatentRefs(resolved))
+	}
+	return result, nil
 }
 
 // Values gets the value wrapped in an array for compatibility
@@ -870,28 +1531,120 @@ func (r *LatentMapRef) Vars() []*VarRef {
 	return []*VarRef{}
 }
 
-// Wraps the value in onionskins of maps according to the keypath. I.e. if the
-// value is 4 and the keypath is ['a', 'b'] the result is {"a": {"b": 4}}
-func buildMapBabushka(keyPath []string, value interface{}) map[string]interface{} {
-	result := map[string]interface{}{}
-	current := result
-	for i, key := range keyPath {
-		if i < len(keyPath)-1 {
-			next := map[string]interface{}{}
-			current[key] = next
-			current = next
-		} else {
-			// last element
-			current[key] = value
+// Wraps the value in onionskins of maps and arrays according to the path. I.e. if
+// the value is 4 and the path is ['a', [0], 'b'] the result is {"a": [{"b": 4}]}
+func buildBabushka(path []latentSegment, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	if path[0].kind == latentKey {
+		inner, err := buildBabushka(path[1:], value)
+		if err != nil {
+			return nil, err
 		}
+		return map[string]interface{}{path[0].key: inner}, nil
 	}
-	return result
+	item, err := buildLatentItem(path[0], path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{item}, nil
+}
+
+// buildLatentItem builds the array item described by an index or keyed item. Keyed
+// items must be maps, or the key identifying them would have nowhere to go.
+func buildLatentItem(segment latentSegment, rest []latentSegment, value interface{}) (interface{}, error) {
+	item, err := buildBabushka(rest, value)
+	if err != nil {
+		return nil, err
+	}
+	if segment.kind != latentKeyedItem {
+		return item, nil
+	}
+	if len(rest) > 0 && rest[0].kind == latentKey && rest[0].key == segment.key {
+		return nil, fmt.Errorf("Cannot set %s of the item with %s == %q, it is the key identifying the item", segment.key, segment.key, segment.value)
+	}
+	if len(rest) == 0 {
+		// The item is the value itself, so make a copy before adding the key to it
+		if _, isMap := item.(map[string]interface{}); !isMap && item != nil {
+			if canonical, _, err := toCanonicalType(item); err == nil {
+				item = canonical
+			}
+		}
+		if m, isMap := item.(map[string]interface{}); isMap {
+			clone := make(map[string]interface{}, len(m)+1)
+			for k, v := range m {
+				clone[k] = v
+			}
+			item = clone
+		}
+	}
+	m, isMap := item.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("Cannot insert %v as the item with %s == %q, only maps can hold %s", item, segment.key, segment.value, segment.key)
+	}
+	if key, exists := m[segment.key]; exists && key != segment.value {
+		return nil, fmt.Errorf("Cannot insert the item with %s == %q, it has %s == %v", segment.key, segment.value, segment.key, key)
+	}
+	m[segment.key] = segment.value
+	return m, nil
+}
+
+// realize creates the latent path in the provided root ref, storing value at the end of it
+func (r *LatentMapRef) realize(ref Ref, value interface{}) error {
+	if arrayRef, ok := ref.(*ArrayRef); ok {
+		item, err := buildLatentItem(r.path[0], r.path[1:], value)
+		if err != nil {
+			return err
+		}
+		return arrayRef.MutateRegions(func(_ string, _ [][]interface{}) ([][]interface{}, error) {
+			return [][]interface{}{{item}}, nil
+		})
+	}
+	value, err := buildBabushka(r.path, value)
+	if err != nil {
+		return err
+	}
+	return ref.Set(value)
 }
 
 // Set sets the value of the contained variable
 func (r *LatentMapRef) Set(value interface{}) error {
 	for _, ref := range individualRefs(r.root) {
-		if err := ref.Set(buildMapBabushka(r.keyPath, value)); err != nil {
+		if err := r.realize(ref, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetIfMissing realizes the latent path like Set, but only below root keys that
+// hold no value at all. Keys that hold some non-map value are left alone rather
+// than being replaced.
+func (r *LatentMapRef) SetIfMissing(value interface{}) error {
+	for _, ref := range individualRefs(r.root) {
+		mapRef, ok := ref.(*MapRef)
+		if !ok {
+			// Array items are only latent when no existing item matched
+			if err := r.realize(ref, value); err != nil {
+				return err
+			}
+			continue
+		}
+		current, err := mapRef.variable.canonicalMap()
+		if err != nil {
+			return err
+		}
+		var missingKeys []string
+		for _, key := range mapRef.keys {
+			if current[key] == nil {
+				missingKeys = append(missingKeys, key)
+			}
+		}
+		if len(missingKeys) == 0 {
+			continue
+		}
+		if err := r.realize(newMapRef(mapRef.variable, missingKeys), value); err != nil {
 			return err
 		}
 	}
@@ -906,19 +1659,62 @@ func (r *LatentMapRef) SetWithMatchedType(value interface{}) error {
 	return r.Set(value)
 }
 
+// identity formats the path that would be created below the root ref
+func (r *LatentMapRef) identity(root Ref) string {
+	if arrayRef, ok := root.(*ArrayRef); ok {
+		return arrayRef.variable.id() + r.pathIdentity()
+	}
+	return fmt.Sprintf("%s.*%s", root.(*MapRef).variable.id(), r.pathIdentity())
+}
+
+// identities formats each path that would be created by the LatentMapRef
+func (r *LatentMapRef) identities() []string {
+	var result []string
+	for _, root := range individualRefs(r.root) {
+		mapRef, ok := root.(*MapRef)
+		if !ok {
+			result = append(result, r.identity(root))
+			continue
+		}
+		for _, key := range mapRef.keys {
+			result = append(result, fmt.Sprintf("%s.%s%s", mapRef.variable.id(), key, r.pathIdentity()))
+		}
+	}
+	return result
+}
+
+// pathIdentity formats the latent path as a jsonmatch path suffix
+func (r *LatentMapRef) pathIdentity() string {
+	var result strings.Builder
+	for _, segment := range r.path {
+		switch segment.kind {
+		case latentKey:
+			result.WriteString("." + segment.key)
+		case latentIndex:
+			result.WriteString("[0]")
+		case latentKeyedItem:
+			fmt.Fprintf(&result, "[%s==%q]", segment.key, segment.value)
+		}
+	}
+	return result.String()
+}
+
 // Mutate mutates values that by definition is non existant. The mutator will
 // recieve the initial value nil
 func (r *LatentMapRef) Mutate(mutator MutatorFunc) error {
-	newPathIdentity := strings.Join(r.keyPath, ".")
 	for _, ref := range individualRefs(r.root) {
-		baseIdentity := ref.(*MapRef).variable.identity
-		identity := fmt.Sprintf("%s.*.%s", baseIdentity, newPathIdentity)
-		value, err := mutator(identity, nil)
+		if _, isItem := ref.(*ArrayRef); isItem {
+			// Items missing from existing arrays are only created by Set
+			continue
+		}
+		value, err := mutator(r.identity(ref), nil)
+		if err == errUnchanged {
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		err = ref.Set(buildMapBabushka(r.keyPath, value))
-		if err != nil {
+		if err = r.realize(ref, value); err != nil {
 			return err
 		}
 	}
@@ -942,7 +1738,10 @@ func (r *LatentMapRef) EstimateSize() int {
 
 // Merge only merges with itself
 func (r *LatentMapRef) Merge(ref Ref) (Ref, bool) {
-	return nil, ref == r
+	if ref == r {
+		return r, true
+	}
+	return nil, false
 }
 
 // Union creates a union
@@ -958,7 +1757,7 @@ func (r *LatentMapRef) Depth() int {
 
 // AddKey adds a key to the keypath of the LatentMapRef
 func (r *LatentMapRef) AddKey(key string) {
-	r.keyPath = append(r.keyPath, key)
+	r.path = append(r.path, latentSegment{kind: latentKey, key: key})
 }
 
 // PathedRef is an interface for refs that have a definitive, resolvable paths, which is effectively Array and Map ref
@@ -967,13 +1766,13 @@ type PathedRef interface {
 }
 
 func (r *MapRef) GetPath() string {
-	return r.variable.identity
+	return r.variable.id()
 }
 
 func (r *ArrayRef) GetPath() string {
-	return r.variable.identity
+	return r.variable.id()
 }
 
 func (r *VarRef) GetPath() string {
-	return r.identity
+	return r.id()
 }
@@ -1,7 +1,9 @@
 package jsonmatch_test
 
 import (
+	"errors"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 
@@ -19,26 +21,35 @@ func varRef(value interface{}, depth int) *jsonmatch.VarRef {
 	getter := func() interface{} {
 		return value
 	}
-	setter := func(newValue interface{}) {
+	setter := func(newValue interface{}) error {
 		value = newValue
+		return nil
 	}
 	return jsonmatch.NewVarRef(identity, getter, setter, depth)
 }
 
-func arrayRefFromIndicies(variable *jsonmatch.VarRef, indicies []int) *jsonmatch.ArrayRef {
-	return jsonmatch.NewArrayRef(variable, jsonmatch.NewRegionsFromIndicies(indicies))
+func arrayRefFromIndicies(t *testing.T, variable *jsonmatch.VarRef, indicies []int) *jsonmatch.ArrayRef {
+	ref, err := jsonmatch.NewArrayRef(variable, jsonmatch.NewRegionsFromIndicies(indicies))
+	require.NoError(t, err)
+	return ref
+}
+
+func mapRef(t *testing.T, variable *jsonmatch.VarRef, keys []string) *jsonmatch.MapRef {
+	ref, err := jsonmatch.NewMapRef(variable, keys)
+	require.NoError(t, err)
+	return ref
 }
 
 func TestArrayRef_Value(t *testing.T) {
 	val := varRef([]interface{}{"zero", "one", "two", "three", "four"}, 0)
-	ref := arrayRefFromIndicies(val, []int{3, 1, 4})
+	ref := arrayRefFromIndicies(t, val, []int{3, 1, 4})
 	selection := ref.Values()
 	assert.Equal(t, []interface{}{"one", "three", "four"}, selection)
 }
 
 func TestArrayRef_Delete(t *testing.T) {
 	base := varRef([]interface{}{"zero", "one", "two", "three", "four"}, 0)
-	ref := arrayRefFromIndicies(base, []int{3, 1, 4})
+	ref := arrayRefFromIndicies(t, base, []int{3, 1, 4})
 	err := ref.Delete()
 	assert.NoError(t, err)
 	assert.Equal(t, []interface{}{"zero", "two"}, base.Value())
@@ -46,7 +57,7 @@ func TestArrayRef_Delete(t *testing.T) {
 
 func TestArrayRef_Set(t *testing.T) {
 	base := varRef([]interface{}{"zero", "one", "two", "three", "four"}, 0)
-	ref := arrayRefFromIndicies(base, []int{3, 1, 4})
+	ref := arrayRefFromIndicies(t, base, []int{3, 1, 4})
 	err := ref.Set("waka")
 	assert.NoError(t, err)
 	assert.Equal(t, []interface{}{"zero", "waka", "two", "waka", "waka"}, base.Value())
@@ -54,7 +65,7 @@ func TestArrayRef_Set(t *testing.T) {
 
 func TestArrayRef_Mutate(t *testing.T) {
 	base := varRef([]interface{}{2, 4, 6, 8}, 0)
-	ref := arrayRefFromIndicies(base, []int{1, 3})
+	ref := arrayRefFromIndicies(t, base, []int{1, 3})
 	err := ref.Mutate(func(path string, value interface{}) (interface{}, error) {
 		return value.(int) / 2, nil
 	})
@@ -64,7 +75,7 @@ func TestArrayRef_Mutate(t *testing.T) {
 
 func TestArrayRef_MutateRegions(t *testing.T) {
 	base := varRef([]interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 0)
-	ref := arrayRefFromIndicies(base, []int{1, 2, 3, 8})
+	ref := arrayRefFromIndicies(t, base, []int{1, 2, 3, 8})
 	err := ref.MutateRegions(func(path string, current [][]interface{}) ([][]interface{}, error) {
 		return [][]interface{}{
 			[]interface{}{"foo"},
@@ -77,8 +88,8 @@ func TestArrayRef_MutateRegions(t *testing.T) {
 
 func TestUnionRef_ArrayRefCanonicalization(t *testing.T) {
 	base := varRef([]interface{}{2, 4, 6, 8}, 0)
-	ref1 := arrayRefFromIndicies(base, []int{1, 3})
-	ref2 := arrayRefFromIndicies(base, []int{2, 3})
+	ref1 := arrayRefFromIndicies(t, base, []int{1, 3})
+	ref2 := arrayRefFromIndicies(t, base, []int{2, 3})
 	union := ref1.Union(ref2)
 	_, ok := union.(*jsonmatch.ArrayRef)
 	assert.True(t, ok, "Union of two ArrayRefs with same base must be an *ArrayRef")
@@ -88,8 +99,8 @@ func TestUnionRef_ArrayRefCanonicalization(t *testing.T) {
 func TestUnionRef_ArrayRefSelectiveCanonicalization(t *testing.T) {
 	base1 := varRef([]interface{}{2, 4, 6, 8}, 1)
 	base2 := varRef([]interface{}{10, 20, 30, 40}, 0)
-	ref1 := arrayRefFromIndicies(base1, []int{1, 3})
-	ref2 := arrayRefFromIndicies(base2, []int{2, 3})
+	ref1 := arrayRefFromIndicies(t, base1, []int{1, 3})
+	ref2 := arrayRefFromIndicies(t, base2, []int{2, 3})
 	union := ref1.Union(ref2)
 	_, ok := union.(*jsonmatch.ArrayRef)
 	assert.False(t, ok, "Union of two ArrayRefs with different base must be a *UnionRef")
@@ -97,7 +108,7 @@ func TestUnionRef_ArrayRefSelectiveCanonicalization(t *testing.T) {
 }
 
 func TestMapRef_Value(t *testing.T) {
-	ref := jsonmatch.NewMapRef(
+	ref := mapRef(t,
 		varRef(map[string]interface{}{
 			"one":   1,
 			"two":   2,
@@ -114,7 +125,7 @@ func TestMapRef_Delete(t *testing.T) {
 		"three": 3,
 		"four":  4,
 	}, 0)
-	ref := jsonmatch.NewMapRef(base, []string{"two", "four"})
+	ref := mapRef(t, base, []string{"two", "four"})
 	assert.NoError(t, ref.Delete())
 	assert.Equal(t, map[string]interface{}{
 		"one":   1,
@@ -129,7 +140,7 @@ func TestMapRef_Set(t *testing.T) {
 		"three": 3,
 		"four":  4,
 	}, 0)
-	ref := jsonmatch.NewMapRef(base, []string{"two", "four"})
+	ref := mapRef(t, base, []string{"two", "four"})
 	assert.NoError(t, ref.Set(100))
 	assert.Equal(t, map[string]interface{}{
 		"one":   1,
@@ -146,7 +157,7 @@ func TestMapRef_Mutate(t *testing.T) {
 		"three": 3,
 		"four":  4,
 	}, 0)
-	ref := jsonmatch.NewMapRef(base, []string{"two", "four"})
+	ref := mapRef(t, base, []string{"two", "four"})
 	err := ref.Mutate(func(path string, value interface{}) (interface{}, error) {
 		return value.(int) * 100, nil
 	})
@@ -166,8 +177,8 @@ func TestUnionRef_MapRefCanonicalization(t *testing.T) {
 		"three": 3,
 		"four":  4,
 	}, 0)
-	ref1 := jsonmatch.NewMapRef(base, []string{"one", "three"})
-	ref2 := jsonmatch.NewMapRef(base, []string{"two", "three"})
+	ref1 := mapRef(t, base, []string{"one", "three"})
+	ref2 := mapRef(t, base, []string{"two", "three"})
 	union := ref1.Union(ref2)
 	_, ok := union.(*jsonmatch.MapRef)
 	assert.True(t, ok, "Union of two MapRefs with same base must be a *MapRef")
@@ -185,19 +196,85 @@ func TestUnionRef_MapRefSelectiveCanonicalization(t *testing.T) {
 		"ten":    10,
 		"twenty": 20,
 	}, 0)
-	ref1 := jsonmatch.NewMapRef(base1, []string{"one", "three"})
-	ref2 := jsonmatch.NewMapRef(base2, []string{"ten"})
+	ref1 := mapRef(t, base1, []string{"one", "three"})
+	ref2 := mapRef(t, base2, []string{"ten"})
 	union := ref1.Union(ref2)
 	_, ok := union.(*jsonmatch.UnionRef)
 	assert.True(t, ok, "Union of two MapRefs with different base must be a *UnionRef")
 	assert.Equal(t, []interface{}{1, 3, 10}, union.Values())
 }
 
+func TestUnionRef_ManyRefs(t *testing.T) {
+	items := make([]interface{}, 100)
+	fields := map[string]interface{}{}
+	for i := range items {
+		items[i] = i
+		fields[strconv.Itoa(i)] = i
+	}
+	array := varRef(items, 0)
+	object := varRef(fields, 0)
+	refs := []jsonmatch.Ref{}
+	// Interleave refs to both bases, most of them overlapping, in descending order
+	for i := 99; i >= 0; i-- {
+		refs = append(refs, arrayRefFromIndicies(t, array, []int{i / 2 * 2}))
+		refs = append(refs, mapRef(t, object, []string{strconv.Itoa(i % 10)}))
+	}
+	union := jsonmatch.NewUnionRef(refs...)
+	unionRef, ok := union.(*jsonmatch.UnionRef)
+	require.True(t, ok)
+	assert.Equal(t, 2, unionRef.Len(), "Refs with the same base must be merged")
+	assert.Equal(t, 2, jsonmatch.NewUnionRef(union, union).(*jsonmatch.UnionRef).Len())
+
+	expected := []int{}
+	for i := 0; i < 100; i += 2 {
+		expected = append(expected, i)
+	}
+	for i := 0; i < 10; i++ {
+		expected = append(expected, i)
+	}
+	sort.Ints(expected)
+	values := []int{}
+	for _, value := range union.Values() {
+		values = append(values, value.(int))
+	}
+	sort.Ints(values)
+	assert.Equal(t, expected, values)
+}
+
+func BenchmarkUnionRef_ManyRefs(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		items := make([]interface{}, n)
+		fields := map[string]interface{}{}
+		for i := range items {
+			fields[strconv.Itoa(i)] = i
+		}
+		refs := make([]jsonmatch.Ref, 0, 2*n)
+		for i := 0; i < n; i++ {
+			array := jsonmatch.NewVarRef("$.items", func() interface{} { return items }, nil, 0)
+			item, _ := jsonmatch.NewArrayRef(array, jsonmatch.Regions{jsonmatch.Region{Start: i, End: i + 1}})
+			refs = append(refs, item)
+			object := jsonmatch.NewVarRef("$.object"+strconv.Itoa(i%100), func() interface{} { return fields }, nil, 0)
+			field, _ := jsonmatch.NewMapRef(object, []string{strconv.Itoa(i)})
+			refs = append(refs, field)
+		}
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				jsonmatch.NewUnionRef(refs...)
+			}
+		})
+	}
+}
+
 func TestVarRef_typePreservation(t *testing.T) {
 	type mapAlias map[string]interface{}
 	base := varRef(mapAlias{"one": 1}, 0)
 	assert.Equal(t, "jsonmatch_test.mapAlias", reflect.TypeOf(base.Value()).String(), "Value should not be the canonical type")
-	assert.Equal(t, "map[string]interface {}", reflect.TypeOf(base.CanonicalValue()).String(), "Value should not be the canonical type")
+	canonical, err := base.CanonicalValue()
+	require.NoError(t, err)
+	assert.Equal(t, "map[string]interface {}", reflect.TypeOf(canonical).String(), "Value should not be the canonical type")
+	_, err = varRef(map[int]interface{}{1: 1}, 0).CanonicalValue()
+	assert.Error(t, err, "Values without a canonical type are an error")
 	assert.NoError(t, base.SetWithMatchedType(map[string]interface{}{"banana": 2}))
 	assert.Equal(t, "jsonmatch_test.mapAlias", reflect.TypeOf(base.Value()).String(),
 		"Type of original value should be preserved after SetWithMatchedType using a canonical type")
@@ -206,10 +283,43 @@ func TestVarRef_typePreservation(t *testing.T) {
 		"Type of original value should be overwritten after straight Set even using a canonical type")
 }
 
+func TestVarRef_MembersOfContainers(t *testing.T) {
+	value := interface{}(map[string]interface{}{"list": []interface{}{1, 2, 3}})
+	base := jsonmatch.NewVarRef("$", func() interface{} {
+		return value
+	}, func(newValue interface{}) error {
+		value = newValue
+		return nil
+	}, 0)
+	list := mapRef(t, base, []string{"list"}).Vars()[0]
+	assert.Equal(t, "list", list.Key())
+	assert.Equal(t, "$.list", list.GetPath())
+	item := arrayRefFromIndicies(t, list, []int{2}).Vars()[0]
+	assert.Equal(t, 2, item.Index())
+	index, ok := item.IndexOk()
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+	assert.Equal(t, "$.list[000002]", item.GetPath())
+	_, ok = item.KeyOk()
+	assert.False(t, ok, "Array items have no key")
+	_, ok = base.IndexOk()
+	assert.False(t, ok, "The root has no index")
+	assert.Panics(t, func() { base.Key() })
+
+	// The variables access their containers when used, so they see later changes
+	require.NoError(t, base.Set(map[string]interface{}{"list": []interface{}{"a", "b", "c"}}))
+	assert.Equal(t, "c", item.Value())
+	require.NoError(t, item.Set("d"))
+	assert.Equal(t, map[string]interface{}{"list": []interface{}{"a", "b", "d"}}, value)
+	require.NoError(t, base.Set(map[string]interface{}{"list": []interface{}{}}))
+	assert.Nil(t, item.Value())
+	assert.Error(t, item.Set("e"), "The item is gone")
+}
+
 func TestUnionRef_MutateMissingKey(t *testing.T) {
 	base := varRef(map[string]interface{}{}, 0)
 	ref := jsonmatch.NewLatentMapRef(
-		jsonmatch.NewMapRef(base, []string{"one"}), []string{"two"})
+		mapRef(t, base, []string{"one"}), []string{"two"})
 	err := ref.Mutate(func(_ string, value interface{}) (interface{}, error) {
 		return "three", nil
 	})
@@ -219,3 +329,49 @@ func TestUnionRef_MutateMissingKey(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, []interface{}{"three"}, ms.Values())
 }
+
+func TestNewRefs_IncompatibleTypes(t *testing.T) {
+	_, err := jsonmatch.NewMapRef(varRef(map[int]interface{}{1: "one"}, 0), []string{"1"})
+	assert.Error(t, err)
+	_, err = jsonmatch.NewMapRef(varRef([]interface{}{}, 0), []string{"one"})
+	assert.Error(t, err)
+	_, err = jsonmatch.NewArrayRef(varRef([3]int{1, 2, 3}, 0), jsonmatch.NewRegionsFromIndicies([]int{0}))
+	assert.Error(t, err)
+	_, err = jsonmatch.NewArrayRef(varRef("string", 0), jsonmatch.NewRegionsFromIndicies([]int{0}))
+	assert.Error(t, err)
+}
+
+func TestVarRef_SetterErrorsPropagate(t *testing.T) {
+	errReadOnly := errors.New("read only")
+	value := interface{}(map[string]interface{}{
+		"a": map[string]interface{}{
+			"list": []interface{}{1, 2, 3},
+		},
+	})
+	root := jsonmatch.NewVarRef("$", func() interface{} {
+		return value
+	}, func(interface{}) error {
+		return errReadOnly
+	}, 0)
+
+	// Walk down to $.a.list through the Vars of each level
+	a := mapRef(t, root, []string{"a"}).Vars()[0]
+	list := mapRef(t, a, []string{"list"}).Vars()[0]
+	ref := arrayRefFromIndicies(t, list, []int{1})
+
+	assert.Equal(t, errReadOnly, ref.Set(10))
+	assert.Equal(t, errReadOnly, ref.Delete())
+	assert.Equal(t, errReadOnly, ref.Mutate(func(_ string, value interface{}) (interface{}, error) {
+		return value, nil
+	}))
+	assert.Equal(t, errReadOnly, ref.Vars()[0].Set(10))
+	assert.Equal(t, []interface{}{1, 2, 3}, list.Value(), "Nothing must change when the setter fails")
+}
+
+func TestVarRef_IncompatibleNestedValues(t *testing.T) {
+	base := varRef(map[string]interface{}{"a": "string"}, 0)
+	a := mapRef(t, base, []string{"a"}).Vars()[0]
+	_, err := jsonmatch.NewMapRef(a, []string{"b"})
+	assert.Error(t, err)
+	assert.Error(t, a.Set(map[int]string{1: "one"}), "Values must be compatible with the canonical types")
+}
@@ -393,6 +393,28 @@ func (rs Regions) Union(otherRegions Regions) Regions {
 	return result
 }
 
+// unionRegions computes the union of many sets of Regions. The sets are combined
+// pairwise like in a merge sort, so each region takes part in a logarithmic number
+// of unions rather than one for every set.
+func unionRegions(sets []Regions) Regions {
+	if len(sets) == 0 {
+		return Regions{}
+	}
+	pending := append([]Regions{}, sets...)
+	for len(pending) > 1 {
+		combined := pending[:0]
+		for i := 0; i < len(pending); i += 2 {
+			if i+1 == len(pending) {
+				combined = append(combined, pending[i])
+			} else {
+				combined = append(combined, pending[i].Union(pending[i+1]))
+			}
+		}
+		pending = combined
+	}
+	return pending[0]
+}
+
 func (rs Regions) Intersect(other Regions) Regions {
 	// Short circuit for empty sets
 	if len(other) == 0 || len(rs) == 0 {
@@ -575,6 +597,21 @@ func NewRegionForEachIndex(indicies []int) Regions {
 	return result
 }
 
+// clip returns the regions limited to the indicies of an array of the given length
+func (rs Regions) clip(length int) Regions {
+	result := make(Regions, 0, len(rs))
+	for _, r := range rs {
+		if r.Start >= length {
+			continue
+		}
+		if r.End > length {
+			r.End = length
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
 // ExtractItems extracts the items in the regions and returns
 // them as an array of arrays with one sub-array with the items of each region
 func (rs Regions) ExtractItems(source []interface{}) [][]interface{} {
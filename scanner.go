@@ -194,7 +194,7 @@ func (s *Scanner) scanNumber() (Token, string, int) {
 			// the beginning of a range operator
 			if ch == '.' {
 				nextCh, _ := s.r.Peek(1)
-				if nextCh[0] == '.' {
+				if len(nextCh) > 0 && nextCh[0] == '.' {
 					// This is a range operator, not a decimal point
 					s.unread()
 					break
@@ -0,0 +1,129 @@
+package jsonmatch
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseSimplePath parses paths consisting only of plain field names and integer
+// indicies, as in `a.b[3].c`, into a list of string keys and int indicies. It
+// returns false for any other path, which must be evaluated by Match.
+func parseSimplePath(path string) ([]interface{}, bool) {
+	var result []interface{}
+	rest := path
+	for i := 0; rest != ""; i++ {
+		if rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, false
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || strings.HasPrefix(rest[1:end], "+") {
+				return nil, false
+			}
+			result = append(result, index)
+			rest = rest[end+1:]
+			continue
+		}
+		if i > 0 {
+			if rest[0] != '.' {
+				return nil, false
+			}
+			rest = rest[1:]
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if !isPlainIdentifier(rest[:end]) {
+			return nil, false
+		}
+		result = append(result, rest[:end])
+		rest = rest[end:]
+	}
+	return result, len(result) > 0
+}
+
+// getSimplePath returns the value at the path, and whether there is one. It
+// returns ok = false if the document is not made of canonical types all the way,
+// in which case Match must be used.
+func getSimplePath(doc interface{}, path []interface{}) (value interface{}, found, ok bool) {
+	value = doc
+	for _, key := range path {
+		switch k := key.(type) {
+		case string:
+			m, isMap := value.(map[string]interface{})
+			if !isMap {
+				return nil, false, value == nil
+			}
+			if value = m[k]; value == nil {
+				// MapRef.Values leaves out members holding nil
+				return nil, false, true
+			}
+		case int:
+			slice, isSlice := value.([]interface{})
+			if !isSlice {
+				return nil, false, value == nil
+			}
+			if k < 0 {
+				k += len(slice)
+			}
+			if k < 0 || k >= len(slice) {
+				return nil, false, true
+			}
+			value = slice[k]
+		}
+	}
+	return value, true, true
+}
+
+// setSimplePath returns a copy of the document with the value set at the path,
+// copying the containers along the path. Only paths that lead to existing
+// containers of canonical types are handled, with the exception of the last key
+// which may be missing from its map. For anything else, ok is false and Match
+// must be used.
+func setSimplePath(doc interface{}, path []interface{}, value interface{}) (result interface{}, ok bool) {
+	if len(path) == 0 {
+		return value, true
+	}
+	switch k := path[0].(type) {
+	case string:
+		m, isMap := doc.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		member, present := m[k]
+		if len(path) > 1 && !present {
+			return nil, false
+		}
+		if member, ok = setSimplePath(member, path[1:], value); !ok {
+			return nil, false
+		}
+		modified := make(map[string]interface{}, len(m)+1)
+		for key, v := range m {
+			modified[key] = v
+		}
+		modified[k] = member
+		return modified, true
+	case int:
+		slice, isSlice := doc.([]interface{})
+		if !isSlice {
+			return nil, false
+		}
+		if k < 0 {
+			k += len(slice)
+		}
+		if k < 0 || k >= len(slice) {
+			return nil, false
+		}
+		item, ok := setSimplePath(slice[k], path[1:], value)
+		if !ok {
+			return nil, false
+		}
+		modified := make([]interface{}, len(slice))
+		copy(modified, slice)
+		modified[k] = item
+		return modified, true
+	}
+	return nil, false
+}
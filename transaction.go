@@ -0,0 +1,178 @@
+package jsonmatch
+
+import (
+	"fmt"
+)
+
+// TxOperation is an operation performed on the values matched by one step of a
+// transaction. It returns the updated document, typically by calling one of the
+// mutating methods of the MatchSet.
+type TxOperation func(ms *MatchSet) (interface{}, error)
+
+// Tx is a queue of mutations to be applied to a document as a whole. Each step
+// pairs a jsonmatch expression with an operation. The steps are applied in order,
+// each one matching against the document as it was left by the previous step. If
+// any step fails, none of the changes are kept.
+type Tx struct {
+	doc   interface{}
+	steps []txStep
+}
+
+type txStep struct {
+	path string
+	op   TxOperation
+	// A predicate expression that must hold for the step to be applied
+	guard string
+}
+
+// TransactionError is returned by Tx.Commit when a step fails. It names the
+// failing step by its position in the queue and its jsonmatch expression.
+type TransactionError struct {
+	// Zero based index of the failing step
+	Step int
+	// The jsonmatch expression of the failing step
+	Path string
+	// The error returned by the step
+	Err error
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("Transaction step %d (%q) failed: %s", e.Step, e.Path, e.Err)
+}
+
+// Unwrap returns the error returned by the failing step
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// Transaction starts a new transaction against the document
+func Transaction(doc interface{}) *Tx {
+	return &Tx{doc: doc}
+}
+
+// Do queues the operation to be performed on the values matched by path
+func (tx *Tx) Do(path string, op TxOperation) *Tx {
+	tx.steps = append(tx.steps, txStep{path: path, op: op})
+	return tx
+}
+
+// Set queues setting the values matched by path. See MatchSet.Set.
+func (tx *Tx) Set(path string, value interface{}) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.Set(value)
+	})
+}
+
+// SetIfMissing queues setting the values matched by path where they are missing.
+// See MatchSet.SetIfMissing.
+func (tx *Tx) SetIfMissing(path string, value interface{}) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.SetIfMissing(value)
+	})
+}
+
+// Delete queues deleting the values matched by path. See MatchSet.Delete.
+func (tx *Tx) Delete(path string) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.Delete()
+	})
+}
+
+// Mutate queues passing the values matched by path through the mutator. See
+// MatchSet.Mutate.
+func (tx *Tx) Mutate(path string, mutator MutatorFunc) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.Mutate(mutator)
+	})
+}
+
+// MutateRegions queues mutating the arrays matched by path. See MatchSet.MutateRegions.
+func (tx *Tx) MutateRegions(path string, mutator MutateRegionsFunc) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.MutateRegions(mutator)
+	})
+}
+
+// CompareAndSet queues setting the values matched by path if they equal expected.
+// See MatchSet.CompareAndSet.
+func (tx *Tx) CompareAndSet(path string, expected, newValue interface{}) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.CompareAndSet(expected, newValue)
+	})
+}
+
+// If guards the most recently queued step with a predicate expression, which is
+// tested against the document as it is when the step is applied. A predicate
+// consisting only of filters, as in `[rev == 3]`, is tested against the document
+// itself. Other predicates hold if they match at least one value. If the
+// predicate does not hold, the transaction fails with a *ConflictError listing
+// the paths of the values compared by the filters, or the predicate itself if it
+// matched nothing. If panics when no step has been queued yet.
+func (tx *Tx) If(predicate string) *Tx {
+	if len(tx.steps) == 0 {
+		panic(fmt.Sprintf("If(%q) must follow the step it guards", predicate))
+	}
+	tx.steps[len(tx.steps)-1].guard = predicate
+	return tx
+}
+
+// Inc queues adding n to the values matched by path. See MatchSet.Inc.
+func (tx *Tx) Inc(path string, n interface{}) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.Inc(n)
+	})
+}
+
+// Dec queues subtracting n from the values matched by path. See MatchSet.Dec.
+func (tx *Tx) Dec(path string, n interface{}) *Tx {
+	return tx.Do(path, func(ms *MatchSet) (interface{}, error) {
+		return ms.Dec(n)
+	})
+}
+
+// Commit applies all queued steps in order and returns the resulting document.
+// If a step fails, the original document is returned along with a
+// *TransactionError. The original document is never modified, so the
+// transaction may be committed again.
+func (tx *Tx) Commit() (interface{}, error) {
+	doc := tx.doc
+	for i, step := range tx.steps {
+		err := step.checkGuard(doc)
+		if err == nil {
+			var ms *MatchSet
+			if ms, err = Match(step.path, doc); err == nil {
+				doc, err = step.op(ms)
+			}
+		}
+		if err != nil {
+			return tx.doc, &TransactionError{Step: i, Path: step.path, Err: err}
+		}
+	}
+	return doc, nil
+}
+
+// checkGuard returns a *ConflictError if the guard of the step does not hold
+func (s txStep) checkGuard(doc interface{}) error {
+	if s.guard == "" {
+		return nil
+	}
+	expr, err := Parse(s.guard)
+	if err != nil {
+		return err
+	}
+	holds, err := expr.holds(doc)
+	if err != nil {
+		return err
+	}
+	if holds {
+		return nil
+	}
+	paths, err := expr.testedPaths(doc)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{s.guard}
+	}
+	return &ConflictError{Paths: paths}
+}
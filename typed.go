@@ -0,0 +1,169 @@
+package jsonmatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// TypeError is returned by the typed accessors when a value can not be converted
+// to the requested type
+type TypeError struct {
+	// The path of the value
+	Path string
+	// The value that could not be converted
+	Value interface{}
+	// The requested type
+	Type reflect.Type
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s: cannot convert %T value %v to %s", e.Path, e.Value, e.Value, e.Type)
+}
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// GetAs returns the value at the path like Get, converted to the type T. Numbers
+// are converted to integer types if it can be done exactly, so 2.0 may be read as
+// an int, but 2.5 may not. Any number may be read as a float, rounded to the
+// nearest one like floatFromValue does, as long as it is within the range of the
+// float type. A *TypeError is returned if the value can not be converted.
+func GetAs[T any](doc interface{}, path string) (T, bool, error) {
+	var zero T
+	value, found, err := Get(doc, path)
+	if err != nil || !found {
+		return zero, found, err
+	}
+	result, err := convertTo[T](path, value)
+	if err != nil {
+		return zero, false, err
+	}
+	return result, true, nil
+}
+
+// ValuesAs returns the values of the MatchSet converted to the type T, as done by
+// GetAs. A *TypeError is returned for the first value that can not be converted.
+func ValuesAs[T any](ms *MatchSet) ([]T, error) {
+	vars := ms.ref.Vars()
+	result := make([]T, 0, len(vars))
+	for _, v := range vars {
+		value := v.Value()
+		if v.inMap && value == nil {
+			// MapRef.Values leaves out members holding nil
+			continue
+		}
+		converted, err := convertTo[T](v.id(), value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// MutateAs mutates the values of the MatchSet like MatchSet.Mutate, passing them
+// to the mutator converted to the type T, as done by GetAs. Values that can not be
+// converted fail with a *TypeError, which is handled according to the ErrorPolicy
+// of the MatchSet like any other error from the mutator.
+func MutateAs[T any](ms *MatchSet, mutator func(path string, value T) (T, error)) (interface{}, error) {
+	return ms.Mutate(func(path string, value interface{}) (interface{}, error) {
+		converted, err := convertTo[T](path, value)
+		if err != nil {
+			return nil, err
+		}
+		return mutator(path, converted)
+	})
+}
+
+// convertTo converts the value at the path to the type T
+func convertTo[T any](path string, value interface{}) (T, error) {
+	var zero T
+	if result, ok := value.(T); ok {
+		return result, nil
+	}
+	target := reflect.TypeOf(&zero).Elem()
+	if converted, ok := convertValue(value, target); ok {
+		return converted.Interface().(T), nil
+	}
+	return zero, &TypeError{Path: path, Value: value, Type: target}
+}
+
+// convertValue converts the value to the target type. Numbers, as recognized by
+// floatFromValue, are converted as described by GetAs. Other
+// values are only converted between types of the same kind, such as named string
+// types and strings, or maps and slices and their canonical types.
+func convertValue(value interface{}, target reflect.Type) (reflect.Value, bool) {
+	if value == nil {
+		switch target.Kind() {
+		case reflect.Interface, reflect.Map, reflect.Slice, reflect.Ptr:
+			return reflect.Zero(target), true
+		}
+		return reflect.Value{}, false
+	}
+	if _, isNumber := floatFromValue(value); isNumber {
+		return convertNumber(value, target)
+	}
+	if canonical, _, err := toCanonicalType(value); err == nil {
+		value = canonical
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == target.Kind() && v.Type().ConvertibleTo(target) {
+		return v.Convert(target), true
+	}
+	return reflect.Value{}, false
+}
+
+// convertNumber converts a numeric value to the target type, integers only if the
+// value can be represented exactly
+func convertNumber(value interface{}, target reflect.Type) (reflect.Value, bool) {
+	result := reflect.New(target).Elem()
+	switch {
+	case target == jsonNumberType:
+		decimal, ok := decimalFromValue(value)
+		if !ok {
+			return reflect.Value{}, false
+		}
+		result.SetString(decimal)
+		return result, true
+	case target.Kind() == reflect.Float32 || target.Kind() == reflect.Float64:
+		return convertToFloat(value, result)
+	}
+	decimal, ok := decimalFromValue(value)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	rat, ok := new(big.Rat).SetString(decimal)
+	if !ok || !rat.IsInt() {
+		return reflect.Value{}, false
+	}
+	n := rat.Num()
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !n.IsInt64() || result.OverflowInt(n.Int64()) {
+			return reflect.Value{}, false
+		}
+		result.SetInt(n.Int64())
+		return result, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n.Sign() < 0 || !n.IsUint64() || result.OverflowUint(n.Uint64()) {
+			return reflect.Value{}, false
+		}
+		result.SetUint(n.Uint64())
+		return result, true
+	}
+	return reflect.Value{}, false
+}
+
+// convertToFloat sets the float result to the numeric value as read by
+// floatFromValue, the way numbers are compared and computed with elsewhere. Like any
+// decimal read as a float, the value is rounded to the nearest float, but it must be
+// within the range of the float type.
+func convertToFloat(value interface{}, result reflect.Value) (reflect.Value, bool) {
+	f, ok := floatFromValue(value)
+	if !ok || result.OverflowFloat(f) {
+		return reflect.Value{}, false
+	}
+	result.SetFloat(f)
+	return result, true
+}
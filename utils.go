@@ -2,31 +2,30 @@ package jsonmatch
 
 import (
 	"encoding/json"
+	"math/big"
 	"reflect"
 	"sort"
 )
 
-func findInKeys(value string, set []string) (int, bool) {
-	for i, v := range set {
-		if value == v {
-			return i, true
-		}
+// unionKeys returns the sorted union of the sets of keys
+func unionKeys(sets ...[]string) []string {
+	size := 0
+	for _, keys := range sets {
+		size += len(keys)
 	}
-	return -1, false
-}
-
-func unionKeys(a, b []string) []string {
-	// TODO: Optimize by sorting superset and using the same "last trick" as in
-	// unionIndicies
-	superset := append(a, b...)
-	result := make([]string, 0, len(superset))
-	for _, candidate := range superset {
-		if _, found := findInKeys(candidate, result); !found {
-			result = append(result, candidate)
-		}
+	result := make([]string, 0, size)
+	for _, keys := range sets {
+		result = append(result, keys...)
 	}
 	sort.Strings(result)
-	return result
+	// Duplicates are next to each other once sorted
+	unique := result[:0]
+	for _, key := range result {
+		if len(unique) == 0 || key != unique[len(unique)-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
 }
 
 func allKeysOfMap(m map[string]interface{}) []string {
@@ -38,14 +37,21 @@ func allKeysOfMap(m map[string]interface{}) []string {
 }
 
 // Returns a Ref to all values on the first sub level of the supplied ref
-func matchAllChildren(varRef *VarRef) Ref {
-	result := NewEmptyRef()
+func matchAllChildren(varRef *VarRef) (Ref, error) {
 	if varRef.IsMap() {
-		result = result.Union(NewMapRef(varRef, allKeysOfMap(varRef.CanonicalValue().(map[string]interface{}))))
+		value, err := varRef.canonicalMap()
+		if err != nil {
+			return nil, err
+		}
+		return newMapRef(varRef, allKeysOfMap(value)), nil
 	} else if varRef.IsSlice() {
-		result = result.Union(NewArrayRef(varRef, Regions{Region{0, len(varRef.CanonicalValue().([]interface{}))}}))
+		value, err := varRef.canonicalSlice()
+		if err != nil {
+			return nil, err
+		}
+		return newArrayRef(varRef, Regions{Region{0, len(value)}}), nil
 	}
-	return result
+	return NewEmptyRef(), nil
 }
 
 // floatFromValue converts any numeric value to a float64.
@@ -85,6 +91,52 @@ func floatFromValue(v interface{}) (float64, bool) {
 	return 0, false
 }
 
+// valuesEqual compares two values deeply. Maps and slices are compared in their
+// canonical form, so type aliases do not matter, and numbers are equal if they
+// represent the same decimal value regardless of their Go type.
+func valuesEqual(a, b interface{}) bool {
+	if decimalA, ok := decimalFromValue(a); ok {
+		decimalB, ok := decimalFromValue(b)
+		if !ok {
+			return false
+		}
+		ratA, okA := new(big.Rat).SetString(decimalA)
+		ratB, okB := new(big.Rat).SetString(decimalB)
+		return okA && okB && ratA.Cmp(ratB) == 0
+	}
+	canonicalA, _, errA := toCanonicalType(a)
+	canonicalB, _, errB := toCanonicalType(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	switch ta := canonicalA.(type) {
+	case map[string]interface{}:
+		tb, ok := canonicalB.(map[string]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for key, value := range ta {
+			other, present := tb[key]
+			if !present || !valuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		tb, ok := canonicalB.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !valuesEqual(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(canonicalA, canonicalB)
+}
+
 // intoInterfaceSlice takes a slice and returns a neutral slice of interfaces.
 // If the input value is not a slice, it returns false as the second return
 // value. If the input value is already []interface{}, the value is returned
@@ -108,3 +160,27 @@ func intoInterfaceSlice(value interface{}) ([]interface{}, bool) {
 }
 
 var intfSliceType = reflect.TypeOf([]interface{}{})
+
+// deepCopy returns a copy of the value sharing no maps or slices with it. The
+// containers of the copy have the canonical types.
+func deepCopy(value interface{}) interface{} {
+	canonical, _, err := toCanonicalType(value)
+	if err != nil {
+		return value
+	}
+	switch t := canonical.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(t))
+		for key, v := range t {
+			result[key] = deepCopy(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, v := range t {
+			result[i] = deepCopy(v)
+		}
+		return result
+	}
+	return canonical
+}
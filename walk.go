@@ -0,0 +1,382 @@
+package jsonmatch
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// errStopWalk is returned by the visitors of walk to end the walk early
+var errStopWalk = errors.New("Walk stopped")
+
+// Exists is true if the expression matches at least one value in the data. The
+// document is only traversed until the first match is found.
+func (expr *Expression) Exists(data interface{}) (bool, error) {
+	if !walkable(expr.root) {
+		ms, err := expr.Match(data)
+		if err != nil {
+			return false, err
+		}
+		return len(ms.Values()) > 0, nil
+	}
+	found := false
+	w := &walker{visitor: func(v *VarRef) error {
+		found = true
+		return errStopWalk
+	}}
+	err := w.walk(newRootVar(data), []node{expr.root})
+	if err != nil && err != errStopWalk {
+		return false, err
+	}
+	return found, nil
+}
+
+// First returns the first value matched by the expression, and whether there was
+// one. Values are ordered as in a depth first traversal of the document, visiting
+// each container before what it holds, map keys in sorted order and array items in
+// order, whatever the order of the unions and recursive descents of the expression.
+// Literals of the expression come after the values of the document. The document
+// is only traversed as far as a value before the first one found may be matched.
+func (expr *Expression) First(data interface{}) (interface{}, bool, error) {
+	if !walkable(expr.root) {
+		ms, err := expr.Match(data)
+		if err != nil {
+			return nil, false, err
+		}
+		first, found := firstInDocumentOrder(ms)
+		return first, found, nil
+	}
+	w := &walker{}
+	w.visitor = func(v *VarRef) error {
+		if w.bound == nil || compareDocumentOrder(v, w.bound) < 0 {
+			w.bound = v
+		}
+		return nil
+	}
+	if err := w.walk(newRootVar(data), []node{expr.root}); err != nil {
+		return nil, false, err
+	}
+	if w.bound == nil {
+		return nil, false, nil
+	}
+	return w.bound.Value(), true, nil
+}
+
+// firstInDocumentOrder returns the value of the MatchSet that comes first in the
+// order of First
+func firstInDocumentOrder(ms *MatchSet) (interface{}, bool) {
+	var first, literal *VarRef
+	for _, v := range ms.ref.Vars() {
+		if v.inMap && v.Value() == nil {
+			// Not a value of the ref, see MapRef.Values
+			continue
+		}
+		top := v
+		for top.parent != nil {
+			top = top.parent
+		}
+		if top != ms.root {
+			// Literals are held by variables of their own
+			if literal == nil {
+				literal = v
+			}
+			continue
+		}
+		if first == nil || compareDocumentOrder(v, first) < 0 {
+			first = v
+		}
+	}
+	if first == nil {
+		first = literal
+	}
+	if first == nil {
+		return nil, false
+	}
+	return first.Value(), true
+}
+
+// compareDocumentOrder compares the positions of two variables of the same document
+// in the order of First, returning -1 if a comes first, 1 if b does and 0 if they
+// are the same value
+func compareDocumentOrder(a, b *VarRef) int {
+	// Containers come before what they hold
+	order := 0
+	levelsA, levelsB := levels(a), levels(b)
+	for ; levelsA > levelsB; levelsA-- {
+		a, order = a.parent, 1
+	}
+	for ; levelsB > levelsA; levelsB-- {
+		b, order = b.parent, -1
+	}
+	// Otherwise the difference closest to the root decides
+	for ; a != nil && b != nil; a, b = a.parent, b.parent {
+		if a.inMap && a.name != b.name {
+			order = strings.Compare(a.name, b.name)
+		} else if !a.inMap && a.index != b.index {
+			order = 1
+			if a.index < b.index {
+				order = -1
+			}
+		}
+	}
+	return order
+}
+
+// levels returns the number of containers holding the variable
+func levels(v *VarRef) int {
+	count := 0
+	for ; v.parent != nil; v = v.parent {
+		count++
+	}
+	return count
+}
+
+// Count returns the number of values matched by the expression, the same as the
+// number of Values of the MatchSet returned by Match, without collecting them.
+func (expr *Expression) Count(data interface{}) (int, error) {
+	if !walkable(expr.root) {
+		ms, err := expr.Match(data)
+		if err != nil {
+			return 0, err
+		}
+		return len(ms.Values()), nil
+	}
+	// Unions and recursive descents may reach the same value more than once
+	seen := map[string]bool{}
+	w := &walker{visitor: func(v *VarRef) error {
+		seen[v.id()] = true
+		return nil
+	}}
+	if err := w.walk(newRootVar(data), []node{expr.root}); err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
+
+// walkable is true if walk supports every node of the expression
+func walkable(n node) bool {
+	switch t := n.(type) {
+	case *pathNode:
+		for _, child := range t.nodes {
+			if !walkable(child) {
+				return false
+			}
+		}
+		return true
+	case *unionNode:
+		for _, child := range t.nodes {
+			if !walkable(child) {
+				return false
+			}
+		}
+		return true
+	case *fieldNode, *existingFieldNode, *indexNode, *sliceNode, *wildcardNode,
+		*recursiveNode, *filterNode, *selfNode:
+		return true
+	}
+	// Literals are not values of the document
+	return false
+}
+
+// walker matches the nodes of an expression starting at a variable, one value at a
+// time rather than one step at a time as process does. The visitor is called with
+// every matched value, and may return errStopWalk to end the walk. The values are
+// the same as the values of the MatchSet returned by Match, but may be visited more
+// than once when unions or recursive descents overlap. Map members holding nil are
+// never matched, as MapRef.Values leaves them out.
+type walker struct {
+	visitor func(*VarRef) error
+	// If set, only values before it in the order of First are of interest, so any
+	// value after it is skipped along with everything it holds
+	bound *VarRef
+}
+
+// skips is true if nothing held by the variable, or the variable itself, is of
+// interest to the walk. As children are walked in order, once one is skipped the
+// rest of them are too.
+func (w *walker) skips(v *VarRef) bool {
+	return w.bound != nil && compareDocumentOrder(v, w.bound) > 0
+}
+
+// walk walks the nodes in sequence starting at the variable
+func (w *walker) walk(v *VarRef, nodes []node) error {
+	if len(nodes) == 0 {
+		return w.visitor(v)
+	}
+	rest := nodes[1:]
+	switch n := nodes[0].(type) {
+	case *pathNode:
+		return w.walk(v, append(append([]node{}, n.nodes...), rest...))
+	case *unionNode:
+		for _, member := range n.nodes {
+			if err := w.walk(v, append([]node{member}, rest...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *selfNode:
+		return w.walk(v, rest)
+	case *fieldNode:
+		return w.walkKey(v, n.name, rest)
+	case *existingFieldNode:
+		return w.walkKey(v, n.name, rest)
+	case *indexNode:
+		if !v.IsSlice() {
+			return nil
+		}
+		value, err := v.canonicalSlice()
+		if err != nil {
+			return err
+		}
+		index := n.value
+		if index < 0 {
+			index += len(value)
+		}
+		if index < 0 || index >= len(value) {
+			return nil
+		}
+		return w.walkRegions(v, Regions{Region{index, index + 1}}, rest)
+	case *sliceNode:
+		if !v.IsSlice() {
+			return nil
+		}
+		value, err := v.canonicalSlice()
+		if err != nil {
+			return err
+		}
+		return w.walkRegions(v, n.regions(len(value)).Sort(), rest)
+	case *wildcardNode:
+		return w.walkChildren(v, func(child *VarRef) error {
+			return w.walk(child, rest)
+		})
+	case *recursiveNode:
+		return w.walkDescendants(v, n, rest)
+	case *filterNode:
+		return w.walkChildren(v, func(child *VarRef) error {
+			isMatch, err := testFilter(child, n)
+			if err != nil || !isMatch {
+				return err
+			}
+			return w.walk(child, rest)
+		})
+	}
+	return errors.New("Expression can not be walked")
+}
+
+// walkDescendants walks the variable and its descendants within the depth bounds of
+// the recursive descent, in document order. The containers still to be visited are
+// kept on a stack rather than recursing, as processRecursive does.
+func (w *walker) walkDescendants(v *VarRef, n *recursiveNode, rest []node) error {
+	type pending struct {
+		variable *VarRef
+		// The level of nesting below the value the recursive descent started from
+		level int
+	}
+	stack := []pending{{v, 0}}
+	var children []*VarRef
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w.skips(current.variable) {
+			// Everything left on the stack comes after it
+			return nil
+		}
+		if current.level >= n.minDepth {
+			if err := w.walk(current.variable, rest); err != nil {
+				return err
+			}
+		}
+		if n.maxDepthSpecified && current.level >= n.maxDepth {
+			continue
+		}
+		children = children[:0]
+		err := w.walkChildren(current.variable, func(child *VarRef) error {
+			children = append(children, child)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, pending{children[i], current.level + 1})
+		}
+	}
+	return nil
+}
+
+// walkKey walks the member of the map held by the variable with the key
+func (w *walker) walkKey(v *VarRef, key string, rest []node) error {
+	if !v.IsMap() {
+		return nil
+	}
+	value, err := v.canonicalMap()
+	if err != nil {
+		return err
+	}
+	if value[key] == nil {
+		return nil
+	}
+	member := newMapRef(v, []string{key}).Vars()[0]
+	if w.skips(member) {
+		return nil
+	}
+	return w.walk(member, rest)
+}
+
+// walkRegions walks the items of the array held by the variable in the regions,
+// which must be sorted
+func (w *walker) walkRegions(v *VarRef, regions Regions, rest []node) error {
+	for _, region := range regions {
+		for i := region.Start; i < region.End; i++ {
+			item := newArrayRef(v, Regions{Region{i, i + 1}}).Vars()[0]
+			if w.skips(item) {
+				return nil
+			}
+			if err := w.walk(item, rest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkChildren calls fn with each child of the variable, in sorted order of the keys
+// of maps or the order of arrays. Map members holding nil are skipped, as are the
+// children skipped by the walker.
+func (w *walker) walkChildren(v *VarRef, fn func(child *VarRef) error) error {
+	if v.IsMap() {
+		value, err := v.canonicalMap()
+		if err != nil {
+			return err
+		}
+		keys := allKeysOfMap(value)
+		sort.Strings(keys)
+		for _, key := range keys {
+			if value[key] == nil {
+				continue
+			}
+			child := newMapRef(v, []string{key}).Vars()[0]
+			if w.skips(child) {
+				return nil
+			}
+			if err := fn(child); err != nil {
+				return err
+			}
+		}
+	} else if v.IsSlice() {
+		value, err := v.canonicalSlice()
+		if err != nil {
+			return err
+		}
+		for i := range value {
+			child := newArrayRef(v, Regions{Region{i, i + 1}}).Vars()[0]
+			if w.skips(child) {
+				return nil
+			}
+			if err := fn(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}